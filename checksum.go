@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+const DefaultSumDB = "sum.golang.org"
+
+// knownSumDBs holds the verifier keys of the public checksum databases
+var knownSumDBs = map[string]string{
+	"sum.golang.org": "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8",
+}
+
+type ChecksumMismatchError struct {
+	Module     module.Version
+	File       string // "zip" or "go.mod"
+	Downloaded string
+	Expected   string
+	Source     string // where the expected hash came from
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s: %s checksum mismatch\n\tdownloaded: %s\n\t%s: %s",
+		e.Module, e.File, e.Downloaded, e.Source, e.Expected)
+}
+
+// SumDBSecurityError is returned when the checksum database proves to be misbehaving,
+// e.g. it served two different trees, so none of its answers can be trusted
+type SumDBSecurityError struct {
+	Module  module.Version
+	Message string
+}
+
+func (e *SumDBSecurityError) Error() string {
+	return fmt.Sprintf("%s: checksum database security error: %s", e.Module, e.Message)
+}
+
+// sumDBOps implements sumdb.ClientOps, fetching over http and caching tiles under cache/sumdb
+type sumDBOps struct {
+	key string
+	url string
+	// securityErr holds the message of the first SecurityError
+	securityErr string
+}
+
+// newSumDBClient parses a GOSUMDB-style setting: "sum.golang.org", "<key>" or "<key> <url>".
+// It returns nil if checksum database verification is turned off.
+func newSumDBClient(setting string) (*sumdb.Client, *sumDBOps, error) {
+	if setting == "" {
+		setting = DefaultSumDB
+	}
+	if setting == "off" {
+		return nil, nil, nil
+	}
+	fields := strings.Fields(setting)
+	key := fields[0]
+	if known, ok := knownSumDBs[key]; ok {
+		key = known
+	}
+	name := key
+	if i := strings.Index(name, "+"); i >= 0 {
+		name = name[:i]
+	}
+	if name == "" || strings.Contains(name, "/") {
+		return nil, nil, fmt.Errorf("invalid sumdb setting: %q", setting)
+	}
+	url := "https://" + name
+	if len(fields) > 1 {
+		url = strings.TrimSuffix(fields[1], "/")
+	}
+	if len(fields) > 2 {
+		return nil, nil, fmt.Errorf("invalid sumdb setting: %q", setting)
+	}
+	ops := &sumDBOps{key: key, url: url}
+	client := sumdb.NewClient(ops)
+	// modules routed to other sources are private, don't leak their paths to a public database
+	client.SetGONOSUMDB(strings.Join([]string{GlobalConfig.NoSumDB, routedPatterns()}, ","))
+	return client, ops, nil
+}
+
+// ReadRemote uses the shared client, so lookups have the download timeouts
+func (o *sumDBOps) ReadRemote(path string) ([]byte, error) {
+	return httpGetBytes(o.url + path)
+}
+
+func (o *sumDBOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(o.key), nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(PluginManagerRoot, "cache", "sumdb", file))
+	if os.IsNotExist(err) {
+		// the latest tree head is empty until the first lookup
+		return []byte{}, nil
+	}
+	return data, err
+}
+
+func (o *sumDBOps) WriteConfig(file string, old, new []byte) error {
+	if file == "key" {
+		return fmt.Errorf("cannot write key")
+	}
+	target := filepath.Join(PluginManagerRoot, "cache", "sumdb", file)
+	data, err := ioutil.ReadFile(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !bytes.Equal(data, old) {
+		return sumdb.ErrWriteConflict
+	}
+	err = os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(target, new, 0666)
+}
+
+func (o *sumDBOps) ReadCache(file string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(PluginManagerRoot, "cache", "sumdb", file))
+}
+
+func (o *sumDBOps) WriteCache(file string, data []byte) {
+	target := filepath.Join(PluginManagerRoot, "cache", "sumdb", file)
+	os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	ioutil.WriteFile(target, data, 0666)
+}
+
+func (o *sumDBOps) Log(msg string) {
+	log.Print(msg)
+}
+
+// SecurityError records msg, the lookup that caused it fails and verifyModuleZip returns it
+func (o *sumDBOps) SecurityError(msg string) {
+	if o.securityErr == "" {
+		o.securityErr = msg
+	}
+}
+
+// hashZipGoMod computes the h1: hash of the go.mod file inside a module zip
+func hashZipGoMod(zipFile string, m module.Version) (string, error) {
+	r, err := zip.OpenReader(zipFile)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.Name == m.Path+"@"+m.Version+"/go.mod" {
+			return dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+				return f.Open()
+			})
+		}
+	}
+	return "", fmt.Errorf("%s: no go.mod found in zip file", m)
+}
+
+// verifyModuleZip checks the h1: hash of a downloaded module zip against expectedHash (if not empty),
+// the .ziphash served by the proxy (if it has one) and the configured checksum database.
+func verifyModuleZip(m module.Version, zipFile, hash, expectedHash string) error {
+	if expectedHash != "" && hash != expectedHash {
+		return &ChecksumMismatchError{Module: m, File: "zip", Downloaded: hash, Expected: expectedHash, Source: "locked"}
+	}
+
+	file, err := moduleFileUrl(m.Path, m.Version, ".ziphash")
+	if err != nil {
+		return err
+	}
+	data, err := proxyGet(m.Path, file)
+	if err == nil {
+		proxyHash := strings.TrimSpace(string(data))
+		if strings.HasPrefix(proxyHash, "h1:") && proxyHash != hash {
+			return &ChecksumMismatchError{Module: m, File: "zip", Downloaded: hash, Expected: proxyHash, Source: "proxy"}
+		}
+	}
+
+	if offline() {
+		log.Printf("%s: offline, skipping checksum database verification", m)
+		return nil
+	}
+	client, ops, err := newSumDBClient(GlobalConfig.SumDB)
+	if err != nil || client == nil {
+		return err
+	}
+	lines, err := client.Lookup(m.Path, m.Version)
+	if ops.securityErr != "" {
+		return &SumDBSecurityError{Module: m, Message: ops.securityErr}
+	}
+	if err == sumdb.ErrGONOSUMDB {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: verifying module: %w", m, err)
+	}
+	modHash, err := hashZipGoMod(zipFile, m)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != m.Path {
+			continue
+		}
+		switch fields[1] {
+		case m.Version:
+			if fields[2] != hash {
+				return &ChecksumMismatchError{Module: m, File: "zip", Downloaded: hash, Expected: fields[2], Source: "sumdb"}
+			}
+		case m.Version + "/go.mod":
+			if fields[2] != modHash {
+				return &ChecksumMismatchError{Module: m, File: "go.mod", Downloaded: modHash, Expected: fields[2], Source: "sumdb"}
+			}
+		}
+	}
+	return nil
+}
+
+// quarantineCacheFile moves a cached file that failed verification into cache/quarantine,
+// so it is neither installed nor served again, but is kept for inspection.
+func quarantineCacheFile(fileName string) error {
+	rel, err := filepath.Rel(cacheDir(), fileName)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		_, rel = filepath.Split(fileName)
+	}
+	target := filepath.Join(PluginManagerRoot, "cache", "quarantine", rel)
+	err = os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(fileName, target)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+type DependencyGraph struct {
+	Root module.Version
+
+	// Edges holds the requirements of every visited module version
+	Edges map[module.Version][]module.Version
+	// Visited holds every module version reached from Root, in the order they were visited
+	Visited []module.Version
+
+	// BuildList holds the selected version of every module, dependencies come before their dependents
+	BuildList []module.Version
+}
+
+// resolveDependencies walks the require graph starting at root and selects
+// the version of each module with minimal version selection, which means the
+// highest version required by any reachable module wins.
+func resolveDependencies(root module.Version) (*DependencyGraph, error) {
+	graph := &DependencyGraph{
+		Root:  root,
+		Edges: map[module.Version][]module.Version{},
+	}
+	selected := map[string]string{}
+	visited := map[module.Version]bool{root: true}
+	queue := []module.Version{root}
+
+	for len(queue) > 0 {
+		m := queue[0]
+		queue = queue[1:]
+		graph.Visited = append(graph.Visited, m)
+		if v, ok := selected[m.Path]; !ok || semver.Compare(m.Version, v) > 0 {
+			selected[m.Path] = m.Version
+		}
+
+		modFile, err := getModuleGoMod(m.Path, m.Version)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range modFile.Require {
+			graph.Edges[m] = append(graph.Edges[m], r.Mod)
+			if !visited[r.Mod] {
+				visited[r.Mod] = true
+				queue = append(queue, r.Mod)
+			}
+		}
+	}
+
+	added := map[string]bool{}
+	var walk func(m module.Version)
+	walk = func(m module.Version) {
+		if added[m.Path] {
+			return
+		}
+		added[m.Path] = true
+		for _, r := range graph.Edges[m] {
+			walk(module.Version{Path: r.Path, Version: selected[r.Path]})
+		}
+		graph.BuildList = append(graph.BuildList, m)
+	}
+	walk(module.Version{Path: root.Path, Version: selected[root.Path]})
+	return graph, nil
+}
+
+func (g *DependencyGraph) Print() {
+	log.Println("Dependency graph")
+	for _, m := range g.Visited {
+		for _, r := range g.Edges[m] {
+			log.Printf("\t%s -> %s", m, r)
+		}
+	}
+	log.Println("Selected versions")
+	for k, m := range g.BuildList {
+		log.Printf("\t[%d] %s", k, m)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// DependentsError is returned by remove when other installed plugins still require the plugins to remove
+type DependentsError struct {
+	Plugins    []string
+	Dependents []string
+}
+
+func (e *DependentsError) Error() string {
+	return fmt.Sprintf("cannot remove %s: required by %s, use --force to remove anyway or --cascade to remove the dependents too",
+		strings.Join(e.Plugins, ", "), strings.Join(e.Dependents, ", "))
+}
+
+// without returns the plugins that are not in removed
+func (w PluginInfos) without(removed PluginInfos) PluginInfos {
+	var ret PluginInfos
+	for _, p := range w {
+		if removed.find(p.Name, p.Version.Original()) == nil {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// newest returns the highest installed version of the module, or nil if it is not installed.
+// Like MVS, a requirement is always satisfied by the highest version.
+func (w PluginInfos) newest(modulePath string) *PluginInfo {
+	var ret *PluginInfo
+	for k, p := range w {
+		if p.Name == modulePath && (ret == nil || p.Version.GreaterThan(ret.Version)) {
+			ret = &w[k]
+		}
+	}
+	return ret
+}
+
+// brokenDependents returns the plugins left after removing removed that require one of the removed
+// modules, and whose requirement is no longer satisfied by another installed version
+func brokenDependents(local, removed PluginInfos) PluginInfos {
+	remaining := local.without(removed)
+	var broken PluginInfos
+	for _, p := range remaining {
+		if p.ModuleInfo == nil {
+			continue
+		}
+		for _, r := range p.ModuleInfo.Require {
+			if removed.newest(r.Mod.Path) == nil {
+				continue
+			}
+			if n := remaining.newest(r.Mod.Path); n == nil || semver.Compare(n.Version.Original(), r.Mod.Version) < 0 {
+				broken = append(broken, p)
+				break
+			}
+		}
+	}
+	return broken
+}
+
+// withDependents adds the plugins that would break to removed, until nothing else breaks.
+// Dependents come first, so they are removed before the plugins they require.
+func withDependents(local, removed PluginInfos) PluginInfos {
+	ret := removed
+	for {
+		broken := brokenDependents(local, ret)
+		if len(broken) == 0 {
+			return dependentsFirst(ret)
+		}
+		ret = append(broken, ret...)
+	}
+}
+
+// dependentsFirst orders the plugins so that every plugin comes before the plugins it requires
+func dependentsFirst(plugins PluginInfos) PluginInfos {
+	var ordered PluginInfos
+	left := plugins
+	for len(left) > 0 {
+		var next, rest PluginInfos
+		for _, p := range left {
+			if requiredBy(left, p) {
+				rest = append(rest, p)
+			} else {
+				next = append(next, p)
+			}
+		}
+		if len(next) == 0 {
+			// the requirements form a cycle, any order breaks it
+			next, rest = rest, nil
+		}
+		ordered = append(ordered, next...)
+		left = rest
+	}
+	return ordered
+}
+
+// requiredBy reports whether another of the plugins requires the module of p
+func requiredBy(plugins PluginInfos, p PluginInfo) bool {
+	for _, q := range plugins {
+		if q.Name == p.Name || q.ModuleInfo == nil {
+			continue
+		}
+		for _, r := range q.ModuleInfo.Require {
+			if r.Mod.Path == p.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// orphanedDependencies returns the installed packages that the lock file records as installed only
+// as a dependency, and that no other installed package requires anymore. Removing an orphan can
+// orphan its own dependencies, so they are included too, dependents first.
+func orphanedDependencies(local PluginInfos, lock *LockFile) PluginInfos {
+	var orphans PluginInfos
+	for {
+		remaining := local.without(orphans)
+		required := map[string]bool{}
+		for _, p := range remaining {
+			if p.ModuleInfo == nil {
+				continue
+			}
+			for _, r := range p.ModuleInfo.Require {
+				if n := remaining.newest(r.Mod.Path); n != nil {
+					required[n.Name+"@"+n.Version.Original()] = true
+				}
+			}
+		}
+		var found PluginInfos
+		for _, p := range remaining {
+			locked := lock.Find(p.Name, p.Version.Original())
+			if locked != nil && !locked.Direct && !required[p.Name+"@"+p.Version.Original()] {
+				found = append(found, p)
+			}
+		}
+		if len(found) == 0 {
+			return dependentsFirst(orphans)
+		}
+		orphans = append(orphans, found...)
+	}
+}
+
+func pluginNames(plugins PluginInfos) []string {
+	var names []string
+	for _, p := range plugins {
+		names = append(names, p.Name+"@"+p.Version.Original())
+	}
+	return names
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// DeployEntry is a file or directory of the package that LiteLoader has to load
+type DeployEntry struct {
+	// Source is relative to the package directory
+	Source string
+	// Target is the directory relative to plugins/ the source is placed in, plugins/ itself if empty
+	Target string
+}
+
+const (
+	DeployCopy    = "copy"
+	DeploySymlink = "symlink"
+)
+
+// DeployCollisionError is returned when a deployed file would replace a file owned by another plugin or the user
+type DeployCollisionError struct {
+	Plugin string
+	File   string
+	Owner  string // module path of the owning plugin, empty if the file is not managed by PluginManager
+}
+
+func (e *DeployCollisionError) Error() string {
+	owner := e.Owner
+	if owner == "" {
+		owner = "the user"
+	}
+	return fmt.Sprintf("%s: %s already exists and belongs to %s", e.Plugin, e.File, owner)
+}
+
+// Deployments records which plugin version owns every file deployed into plugins/
+type Deployments struct {
+	// Files maps paths relative to plugins/, with forward slashes, to their owner
+	Files map[string]module.Version `json:"files"`
+}
+
+// pluginsDir is the directory of the server LiteLoader loads plugins from
+func pluginsDir() string {
+	return filepath.Join(serverDir(), "plugins")
+}
+
+func deploymentsPath() string {
+	return filepath.Join(PluginManagerRoot, "deployments.json")
+}
+
+// loadDeployments reads deployments.json, a missing file is treated as empty
+func loadDeployments() (*Deployments, error) {
+	d := &Deployments{Files: map[string]module.Version{}}
+	data, err := os.ReadFile(deploymentsPath())
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, d)
+	if d.Files == nil {
+		d.Files = map[string]module.Version{}
+	}
+	return d, err
+}
+
+func (d *Deployments) Save() error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := deploymentsPath() + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, deploymentsPath())
+}
+
+// deployFiles returns the files of the package to deploy, mapped from their path in the package
+// to their path relative to plugins/. Directories are deployed with all their files.
+func deployFiles(p PluginInfo) (map[string]string, error) {
+	pkgDir, err := filepath.Abs(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	managerDir, err := filepath.Abs(PluginManagerRoot)
+	if err != nil {
+		return nil, err
+	}
+	targetRoot, err := filepath.Abs(pluginsDir())
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]string{}
+	for _, e := range p.Manifest.Deploy {
+		src := filepath.Join(pkgDir, filepath.FromSlash(e.Source))
+		if e.Source == "" || !isWithin(src, pkgDir) || src == pkgDir {
+			return nil, fmt.Errorf("%s: deploy source %q is outside of the package", p.Name, e.Source)
+		}
+		targetDir := filepath.Join(targetRoot, filepath.FromSlash(e.Target))
+		if !isWithin(targetDir, targetRoot) || isWithin(targetDir, managerDir) {
+			return nil, fmt.Errorf("%s: deploy target %q must be in %s and outside of %s", p.Name, e.Target, pluginsDir(), PluginManagerRoot)
+		}
+		err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return fmt.Errorf("%s: deploy source %s is not a regular file", p.Name, path)
+			}
+			rel, err := filepath.Rel(filepath.Dir(src), path)
+			if err != nil {
+				return err
+			}
+			target, err := filepath.Rel(targetRoot, filepath.Join(targetDir, rel))
+			if err != nil {
+				return err
+			}
+			files[path] = filepath.ToSlash(target)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// deployPlugin copies or links the files declared in the manifest into plugins/ and records them as owned
+// by the plugin. Files owned by another version of the same plugin are taken over, any other existing file
+// is a collision and nothing is deployed. Disabled plugins are not deployed.
+func deployPlugin(t *Transaction, p PluginInfo) error {
+	if len(p.Manifest.Deploy) == 0 || isPluginDisabled(p.Name) {
+		return nil
+	}
+	files, err := deployFiles(p)
+	if err != nil {
+		return err
+	}
+	d, err := loadDeployments()
+	if err != nil {
+		return err
+	}
+	owner := module.Version{Path: p.Name, Version: p.Version.Original()}
+
+	for _, target := range files {
+		if o, ok := d.Files[target]; ok {
+			if o.Path != p.Name {
+				return &DeployCollisionError{Plugin: p.Name, File: target, Owner: o.Path}
+			}
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(pluginsDir(), filepath.FromSlash(target))); err == nil {
+			return &DeployCollisionError{Plugin: p.Name, File: target}
+		}
+	}
+
+	for src, target := range files {
+		err = deployFile(t, src, filepath.Join(pluginsDir(), filepath.FromSlash(target)))
+		if err != nil {
+			return err
+		}
+		d.Files[target] = owner
+	}
+	log.Printf("deployed %d files of %s[%s]", len(files), p.Name, p.Version)
+	return d.Save()
+}
+
+func deployFile(t *Transaction, src, dst string) error {
+	err := t.mkdirAll(filepath.Dir(dst))
+	if err != nil {
+		return err
+	}
+	// a file taken over from another version of the plugin is replaced
+	err = t.remove(dst)
+	if err != nil {
+		return err
+	}
+	err = t.create(dst)
+	if err != nil {
+		return err
+	}
+	if GlobalConfig.DeployMode == DeploySymlink {
+		return os.Symlink(src, dst)
+	}
+	return copyLocalFile(src, dst)
+}
+
+// removeDeployedFile deletes a deployed file, and the directories that become empty up to plugins/
+func removeDeployedFile(t *Transaction, target string) error {
+	path := filepath.Join(pluginsDir(), filepath.FromSlash(target))
+	err := t.remove(path)
+	if err != nil {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != pluginsDir() && dir != "."; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// undeployPlugin deletes exactly the files owned by the plugin version from plugins/
+func undeployPlugin(t *Transaction, p PluginInfo) error {
+	d, err := loadDeployments()
+	if err != nil {
+		return err
+	}
+	var targets []string
+	for target, o := range d.Files {
+		if o.Path == p.Name && o.Version == p.Version.Original() {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		err = removeDeployedFile(t, target)
+		if err != nil {
+			return err
+		}
+		delete(d.Files, target)
+	}
+	log.Printf("removed %d deployed files of %s[%s]: %s", len(targets), p.Name, p.Version, strings.Join(targets, ", "))
+	return d.Save()
+}
@@ -1,15 +1,98 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dustin/go-humanize"
 )
 
+// DownloadConfig controls retries and timeouts of DownloadFile, zero values use the defaults
+type DownloadConfig struct {
+	Retries         int `json:"retries"`         // -1 disables retries
+	ConnectTimeout  int `json:"connectTimeout"`  // seconds to establish a connection
+	ResponseTimeout int `json:"responseTimeout"` // seconds to wait for the response headers
+	StallTimeout    int `json:"stallTimeout"`    // seconds without receiving any data before giving up
+	MaxBackoff      int `json:"maxBackoff"`      // upper bound of the seconds to wait between retries
+	Concurrency     int `json:"concurrency"`     // metadata requests sent at the same time
+}
+
+const (
+	DefaultDownloadRetries         = 5
+	DefaultDownloadConnectTimeout  = 15
+	DefaultDownloadResponseTimeout = 30
+	DefaultDownloadStallTimeout    = 30
+	DefaultDownloadMaxBackoff      = 60
+	DefaultDownloadConcurrency     = 8
+)
+
+func (c DownloadConfig) withDefaults() DownloadConfig {
+	if c.Retries == 0 {
+		c.Retries = DefaultDownloadRetries
+	} else if c.Retries < 0 {
+		c.Retries = 0
+	}
+	if c.ConnectTimeout == 0 {
+		c.ConnectTimeout = DefaultDownloadConnectTimeout
+	}
+	if c.ResponseTimeout == 0 {
+		c.ResponseTimeout = DefaultDownloadResponseTimeout
+	}
+	if c.StallTimeout == 0 {
+		c.StallTimeout = DefaultDownloadStallTimeout
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = DefaultDownloadMaxBackoff
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = DefaultDownloadConcurrency
+	}
+	return c
+}
+
+func newDownloadClient(c DownloadConfig) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   time.Duration(c.ConnectTimeout) * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   time.Duration(c.ConnectTimeout) * time.Second,
+			ResponseHeaderTimeout: time.Duration(c.ResponseTimeout) * time.Second,
+			MaxIdleConnsPerHost:   c.Concurrency,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+}
+
+var sharedClient struct {
+	once   sync.Once
+	client *http.Client
+}
+
+// httpClient returns the client shared by every request, so connections to the sources are kept alive
+// and reused by the parallel metadata requests
+func httpClient() *http.Client {
+	sharedClient.once.Do(func() {
+		sharedClient.client = newDownloadClient(GlobalConfig.Download.withDefaults())
+	})
+	return sharedClient.client
+}
+
 type DownloadProgressPrinter struct {
 	Count    uint64
 	Total    uint64
@@ -24,46 +107,193 @@ func (w *DownloadProgressPrinter) Write(p []byte) (int, error) {
 }
 
 func (w DownloadProgressPrinter) RefreshProgress() {
-	fmt.Printf("\r%s", strings.Repeat(" ", 40+len(w.FileName)))
-	fmt.Printf("\rDownloading %s\t[%s/%s]", w.FileName, humanize.Bytes(w.Count), humanize.Bytes(w.Total))
+	fmt.Fprintf(os.Stderr, "\r%s", strings.Repeat(" ", 40+len(w.FileName)))
+	fmt.Fprintf(os.Stderr, "\rDownloading %s\t[%s/%s]", w.FileName, humanize.Bytes(w.Count), humanize.Bytes(w.Total))
+}
+
+// stallReader cancels the download if no data arrives for timeout
+type stallReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.timer.Reset(s.timeout)
+	return n, err
+}
+
+var errDownloadStalled = errors.New("download stalled")
+
+// errUnexpectedRange is returned when the server answered a Range request with another range
+var errUnexpectedRange = errors.New("unexpected Content-Range")
+
+// jitter spreads the retries of servers that failed at the same time
+var jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// isRetryable reports whether a failed download attempt may succeed if tried again: network errors,
+// interrupted transfers and 5xx or 429 responses. Local errors, like a full disk, are not retried.
+func isRetryable(err error) bool {
+	var statusErr *HttpStatusError
+	if errors.As(err, &statusErr) {
+		code := statusErr.StatusCode
+		return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests ||
+			code == http.StatusRequestedRangeNotSatisfiable
+	}
+	return isNetworkError(err) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, errDownloadStalled) || errors.Is(err, errUnexpectedRange)
+}
+
+// isNetworkError reports whether err comes from a request or a connection. It doesn't match
+// net.Error, syscall.Errno implements it too, so a local error like a full disk would match.
+func isNetworkError(err error) bool {
+	var urlErr *url.Error
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return errors.As(err, &urlErr) || errors.As(err, &opErr) || errors.As(err, &dnsErr)
+}
+
+// backoff returns the delay before the given retry: exponential, capped, with jitter
+func backoff(retry int, max time.Duration) time.Duration {
+	d := time.Second << uint(retry-1)
+	if d > max || d <= 0 {
+		d = max
+	}
+	return d/2 + time.Duration(jitter.Int63n(int64(d/2)+1))
 }
 
 // DownloadFile will download an url to a local file. It's efficient because it will
 // write as it downloads and not load the whole file into memory. We pass an io.TeeReader
 // into Copy() to report progress on the download.
+// Failed attempts are retried with backoff, and continue from the data already
+// in the .tmp file using a Range request.
 func DownloadFile(filepath string, url string) error {
+	config := GlobalConfig.Download.withDefaults()
+	client := httpClient()
+
+	var err error
+	for attempt := 0; attempt <= config.Retries; attempt++ {
+		if attempt > 0 {
+			delay := backoff(attempt, time.Duration(config.MaxBackoff)*time.Second)
+			log.Printf("download of %s failed: %v, retrying in %v", url, err, delay.Round(time.Millisecond))
+			time.Sleep(delay)
+		}
+		err = downloadAttempt(client, config, filepath, url)
+		if err == nil || !isRetryable(err) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	os.Remove(filepath + ".tmp.validator")
+	if err = os.Rename(filepath+".tmp", filepath); err != nil {
+		return err
+	}
+	return nil
+}
 
+func downloadAttempt(client *http.Client, config DownloadConfig, filepath string, url string) error {
 	// Create the file, but give it a tmp file extension, this means we won't overwrite a
 	// file until it's downloaded, but we'll remove the tmp extension once downloaded.
-	out, err := os.Create(filepath + ".tmp")
+	tmpFile := filepath + ".tmp"
+	validatorFile := tmpFile + ".validator"
+
+	// A partial download can only be resumed if the server told us how to make sure it didn't change
+	var offset int64
+	validator, _ := ioutil.ReadFile(validatorFile)
+	if stat, err := os.Stat(tmpFile); err == nil && len(validator) > 0 {
+		offset = stat.Size()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return err
 	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", string(validator))
+	}
 
 	// Get the data
-	resp, err := http.Get(url)
+	resp, err := client.Do(req)
 	if err != nil {
-		out.Close()
 		return err
 	}
 	defer resp.Body.Close()
 
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			os.Remove(validatorFile)
+			return fmt.Errorf("%w %q", errUnexpectedRange, resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// the server sent the whole file, the partial data is stale
+		offset = 0
+		flags |= os.O_TRUNC
+	case http.StatusRequestedRangeNotSatisfiable:
+		os.Remove(tmpFile)
+		os.Remove(validatorFile)
+		return &HttpStatusError{Url: url, StatusCode: resp.StatusCode}
+	default:
+		return &HttpStatusError{Url: url, StatusCode: resp.StatusCode}
+	}
+
+	if v := resp.Header.Get("ETag"); v != "" && !strings.HasPrefix(v, "W/") {
+		ioutil.WriteFile(validatorFile, []byte(v), 0644)
+	} else if v := resp.Header.Get("Last-Modified"); v != "" {
+		ioutil.WriteFile(validatorFile, []byte(v), 0644)
+	} else {
+		os.Remove(validatorFile)
+	}
+
+	out, err := os.OpenFile(tmpFile, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
 	// Create our progress reporter and pass it to be used alongside our writer
 	counter := &DownloadProgressPrinter{
 		FileName: filepath,
-		Total:    uint64(resp.ContentLength),
+		Count:    uint64(offset),
 	}
-	if _, err = io.Copy(out, io.TeeReader(resp.Body, counter)); err != nil {
-		out.Close()
-		return err
+	if resp.ContentLength >= 0 {
+		counter.Total = uint64(offset + resp.ContentLength)
 	}
+	stallTimeout := time.Duration(config.StallTimeout) * time.Second
+	var stalled int32
+	body := &stallReader{
+		r:       resp.Body,
+		timeout: stallTimeout,
+		timer: time.AfterFunc(stallTimeout, func() {
+			atomic.StoreInt32(&stalled, 1)
+			cancel()
+		}),
+	}
+	defer body.timer.Stop()
 
-	fmt.Print("\tDone\n")
-
-	out.Close()
-
-	if err = os.Rename(filepath+".tmp", filepath); err != nil {
+	n, err := io.Copy(out, io.TeeReader(body, counter))
+	if err != nil {
+		fmt.Fprint(os.Stderr, "\n")
+		if atomic.LoadInt32(&stalled) == 1 {
+			return errDownloadStalled
+		}
 		return err
 	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		fmt.Fprint(os.Stderr, "\n")
+		return io.ErrUnexpectedEOF
+	}
+
+	fmt.Fprint(os.Stderr, "\tDone\n")
 	return nil
 }
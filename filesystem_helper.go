@@ -1,15 +1,22 @@
 package main
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 )
 
-func initDirs() {
-	os.MkdirAll(PluginManagerRoot, os.ModePerm)
-	os.MkdirAll(filepath.Join(PluginManagerRoot, "pkg"), os.ModePerm)
-	os.MkdirAll(filepath.Join(PluginManagerRoot, "cache"), os.ModePerm)
+// initDirs creates PluginManagerRoot and its directories, it must only run after resolveRoot
+// confirmed the server directory
+func initDirs() error {
+	for _, dir := range []string{PluginManagerRoot, filepath.Join(PluginManagerRoot, "pkg"), filepath.Join(PluginManagerRoot, "cache")} {
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 func findEmptyFolder(path string) (err error) {
 	dir, err := ioutil.ReadDir(path)
@@ -46,3 +53,30 @@ func removeEmptyFolders(path string) error {
 	}
 	return nil
 }
+
+// copyLocalFile copies src to dst through a temporary file. If src is dst, as for the cache as the
+// offline source, it only has to exist.
+func copyLocalFile(src, dst string) error {
+	if filepath.Clean(src) == filepath.Clean(dst) {
+		_, err := os.Stat(src)
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst + ".tmp")
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
@@ -7,11 +7,42 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 )
 
-func newVmInstance() *otto.Otto {
+// scriptOutput receives the console output of scripts
+var scriptOutput io.Writer = os.Stdout
+
+// newVmInstance creates a VM whose filesystem, system and network functions are limited by sandbox.
+// Calls outside of the sandbox throw a PermissionError in the script.
+func newVmInstance(sandbox *vmSandbox) *otto.Otto {
 	vm := otto.New()
 
+	// allowPath returns the path of arg if the sandbox allows op on it, or throws a PermissionError
+	allowPath := func(op string, arg otto.Value) string {
+		path, err := sandbox.checkPath(op, arg.String())
+		if err != nil {
+			panic(vm.MakeCustomError("PermissionError", err.Error()))
+		}
+		return path
+	}
+
+	// console replaces the builtin one, which always writes to stdout
+	consoleLog := func(call otto.FunctionCall) otto.Value {
+		args := make([]string, len(call.ArgumentList))
+		for k, arg := range call.ArgumentList {
+			args[k] = arg.String()
+		}
+		fmt.Fprintln(scriptOutput, strings.Join(args, " "))
+		return otto.UndefinedValue()
+	}
+	console := map[string]interface{}{
+		"log":   consoleLog,
+		"info":  consoleLog,
+		"warn":  consoleLog,
+		"error": consoleLog,
+	}
+
 	// jsFilesystem impl some simple functions for file Read, Write, etc.
 	// it's basically a wrapper for Golang.OS
 	type jsFilesystem struct {
@@ -57,16 +88,35 @@ func newVmInstance() *otto.Otto {
 	}
 
 	type jsSystem struct {
+		// Run an approved command
+		// jsRef: Cmd(name: "cmd", args: "/C", "dir")
+		// return null if success, or error message if failed
 		Cmd func(call otto.FunctionCall) otto.Value
 	}
 
+	// jsNetwork is only usable if the plugin was granted the network permission
+	type jsNetwork struct {
+		// Get the body of an url
+		// jsRef: Get(url: "https://example.com")
+		// return the body if success, or error message if failed
+		Get func(call otto.FunctionCall) otto.Value
+	}
+
 	sys := jsSystem{
 		Cmd: func(call otto.FunctionCall) otto.Value {
+			if len(call.ArgumentList) == 0 {
+				panic(vm.MakeTypeError("Cmd needs the name of the command"))
+			}
+			if err := sandbox.checkCommand(call.Argument(0).String()); err != nil {
+				panic(vm.MakeCustomError("PermissionError", err.Error()))
+			}
 			args := make([]string, len(call.ArgumentList)-1)
 			for k, arg := range call.ArgumentList[1:] {
 				args[k] = arg.String()
 			}
-			err := exec.Command(call.Argument(0).String(), args...).Run()
+			cmd := exec.Command(call.Argument(0).String(), args...)
+			cmd.Dir = sandbox.ServerRoot
+			err := cmd.Run()
 			if err != nil {
 				ret, _ := vm.ToValue(err.Error())
 				return ret
@@ -75,6 +125,22 @@ func newVmInstance() *otto.Otto {
 		},
 	}
 
+	network := jsNetwork{
+		Get: func(call otto.FunctionCall) otto.Value {
+			url := call.Argument(0).String()
+			if err := sandbox.checkNetwork(url); err != nil {
+				panic(vm.MakeCustomError("PermissionError", err.Error()))
+			}
+			data, err := httpGetBytes(url)
+			if err != nil {
+				ret, _ := vm.ToValue(err.Error())
+				return ret
+			}
+			ret, _ := vm.ToValue(string(data))
+			return ret
+		},
+	}
+
 	fs := jsFilesystem{
 		Copy: func(call otto.FunctionCall) otto.Value {
 			//copy file wrapper
@@ -101,7 +167,7 @@ func newVmInstance() *otto.Otto {
 				defer destination.Close()
 				nBytes, err := io.Copy(destination, source)
 				return nBytes, err
-			}(call.Argument(0).String(), call.Argument(1).String())
+			}(allowPath("copy", call.Argument(0)), allowPath("copy", call.Argument(1)))
 
 			if err != nil {
 				ret, _ := vm.ToValue(err.Error())
@@ -112,7 +178,7 @@ func newVmInstance() *otto.Otto {
 		},
 		Delete: func(call otto.FunctionCall) otto.Value {
 			//delete file wrapper
-			err := os.Remove(call.Argument(0).String())
+			err := os.Remove(allowPath("delete", call.Argument(0)))
 			if err != nil {
 				ret, _ := vm.ToValue(err.Error())
 				return ret
@@ -121,7 +187,7 @@ func newVmInstance() *otto.Otto {
 		},
 		Exists: func(call otto.FunctionCall) otto.Value {
 			//exists file wrapper
-			_, err := os.Stat(call.Argument(0).String())
+			_, err := os.Stat(allowPath("exists", call.Argument(0)))
 			if err != nil {
 				ret, _ := vm.ToValue(false)
 				return ret
@@ -131,7 +197,7 @@ func newVmInstance() *otto.Otto {
 		},
 		Create: func(call otto.FunctionCall) otto.Value {
 			//create file wrapper
-			file, err := os.Create(call.Argument(0).String())
+			file, err := os.Create(allowPath("create", call.Argument(0)))
 			if err != nil {
 				ret, _ := vm.ToValue(err.Error())
 				return ret
@@ -141,7 +207,7 @@ func newVmInstance() *otto.Otto {
 		},
 		Mkdir: func(call otto.FunctionCall) otto.Value {
 			//mkdir wrapper
-			err := os.Mkdir(call.Argument(0).String(), 0777)
+			err := os.Mkdir(allowPath("mkdir", call.Argument(0)), 0777)
 			if err != nil {
 				ret, _ := vm.ToValue(err.Error())
 				return ret
@@ -150,7 +216,7 @@ func newVmInstance() *otto.Otto {
 		},
 		Read: func(call otto.FunctionCall) otto.Value {
 			//read file wrapper
-			file, err := os.Open(call.Argument(0).String())
+			file, err := os.Open(allowPath("read", call.Argument(0)))
 			if err != nil {
 				ret, _ := vm.ToValue(err.Error())
 				return ret
@@ -166,7 +232,7 @@ func newVmInstance() *otto.Otto {
 		},
 		Write: func(call otto.FunctionCall) otto.Value {
 			//write file wrapper
-			file, err := os.Create(call.Argument(0).String())
+			file, err := os.Create(allowPath("write", call.Argument(0)))
 			if err != nil {
 				ret, _ := vm.ToValue(err.Error())
 				return ret
@@ -181,7 +247,7 @@ func newVmInstance() *otto.Otto {
 		},
 		Append: func(call otto.FunctionCall) otto.Value {
 			//append file wrapper
-			file, err := os.OpenFile(call.Argument(0).String(), os.O_APPEND|os.O_WRONLY, 0600)
+			file, err := os.OpenFile(allowPath("append", call.Argument(0)), os.O_APPEND|os.O_WRONLY, 0600)
 			if err != nil {
 				ret, _ := vm.ToValue(err.Error())
 				return ret
@@ -196,9 +262,29 @@ func newVmInstance() *otto.Otto {
 		},
 	}
 
+	vm.Set("console", console)
 	vm.Set("system", sys)
+	vm.Set("network", network)
 	vm.Set("filesystem", fs)
 
 	return vm
 
 }
+
+// runScriptFile compiles and runs the script file in vm.
+// Runtime errors are returned with their stack trace, so the failing line is shown.
+func runScriptFile(vm *otto.Otto, filename string) error {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	script, err := vm.Compile(filename, src)
+	if err != nil {
+		return err
+	}
+	_, err = vm.Run(script)
+	if jsErr, ok := err.(*otto.Error); ok {
+		return fmt.Errorf("%s", strings.TrimSpace(jsErr.String()))
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Journal operations. Every step is written before it is carried out, so after a crash the
+// journal lists everything that might have happened.
+const (
+	// JournalBegin starts a transaction, Path is its staging directory and Name the operation
+	JournalBegin = "begin"
+	// JournalSnapshot records that Backup holds the content Path had when the transaction began
+	JournalSnapshot = "snapshot"
+	// JournalRemove records that Path is moved to Backup
+	JournalRemove = "remove"
+	// JournalCreate records that Path is created, it did not exist before
+	JournalCreate = "create"
+	// JournalCommit records that every step succeeded, only the cleanup is left
+	JournalCommit = "commit"
+)
+
+// JournalEntry is one line of the journal
+type JournalEntry struct {
+	Op     string `json:"op"`
+	Name   string `json:"name,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Backup string `json:"backup,omitempty"`
+}
+
+// journalPath is the write-ahead journal of the running transaction, it only exists while one runs
+func journalPath() string {
+	return filepath.Join(PluginManagerRoot, "journal")
+}
+
+// appendJournal writes the entry and waits until it is on disk
+func appendJournal(f *os.File, e JournalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// readJournal returns the entries of the journal. A torn last line, written when the process died
+// during the write, is ignored since its step was never started.
+func readJournal() ([]JournalEntry, error) {
+	f, err := os.Open(journalPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e JournalEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// recoverJournal finishes the transaction of an unfinished journal left by a killed process.
+// A committed transaction only needs its staging directory removed, any other is rolled back
+// by undoing its recorded steps in reverse order. The scripts the plugins ran are not undone.
+// Partial downloads in the cache are kept, DownloadFile resumes them.
+func recoverJournal() error {
+	entries, err := readJournal()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var dir, name string
+	committed := false
+	for _, e := range entries {
+		switch e.Op {
+		case JournalBegin:
+			dir, name = e.Path, e.Name
+		case JournalCommit:
+			committed = true
+		}
+	}
+	if committed {
+		log.Printf("finishing interrupted %s", name)
+	} else {
+		log.Printf("rolling back interrupted %s", name)
+		for k := len(entries) - 1; k >= 0; k-- {
+			err = undoJournalEntry(entries[k])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if dir != "" {
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(journalPath())
+}
+
+// undoJournalEntry reverts a step that may or may not have been carried out,
+// together with the .tmp file it may have left
+func undoJournalEntry(e JournalEntry) error {
+	switch e.Op {
+	case JournalSnapshot:
+		if _, err := os.Stat(e.Backup); err != nil {
+			return nil
+		}
+		err := copyLocalFile(e.Backup, e.Path)
+		if err != nil {
+			return err
+		}
+		return removeIfExists(e.Path + ".tmp")
+	case JournalCreate:
+		err := os.RemoveAll(e.Path)
+		if err != nil {
+			return err
+		}
+		return removeIfExists(e.Path + ".tmp")
+	case JournalRemove:
+		if _, err := os.Lstat(e.Backup); err != nil {
+			// the move never happened
+			return nil
+		}
+		err := os.MkdirAll(filepath.Dir(e.Path), os.ModePerm)
+		if err != nil {
+			return err
+		}
+		return os.Rename(e.Backup, e.Path)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type LockedModule struct {
+	Path        string    `json:"path"`
+	Version     string    `json:"version"`
+	Hash        string    `json:"hash"` // h1: hash of the module zip, same format as go.sum
+	InstallTime time.Time `json:"installTime"`
+	Direct      bool      `json:"direct"` // false if the module was only installed as a dependency
+}
+
+type LockFile struct {
+	Modules []LockedModule `json:"modules"`
+}
+
+func lockFilePath() string {
+	return filepath.Join(PluginManagerRoot, "PluginManager.lock")
+}
+
+// loadLockFile reads PluginManager.lock, a missing lock file is treated as empty
+func loadLockFile() (*LockFile, error) {
+	lock := &LockFile{}
+	file, err := os.Open(lockFilePath())
+	if os.IsNotExist(err) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	err = json.NewDecoder(file).Decode(lock)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+func (l *LockFile) Save() error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := lockFilePath() + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, lockFilePath())
+}
+
+func (l *LockFile) Find(modulePath, versionStr string) *LockedModule {
+	for k, m := range l.Modules {
+		if m.Path == modulePath && m.Version == versionStr {
+			return &l.Modules[k]
+		}
+	}
+	return nil
+}
+
+// Add records m, replacing the entry of the same module version if there is one
+func (l *LockFile) Add(m LockedModule) {
+	if old := l.Find(m.Path, m.Version); old != nil {
+		*old = m
+		return
+	}
+	l.Modules = append(l.Modules, m)
+}
+
+func (l *LockFile) Remove(modulePath, versionStr string) {
+	modules := l.Modules[:0]
+	for _, m := range l.Modules {
+		if m.Path != modulePath || m.Version != versionStr {
+			modules = append(modules, m)
+		}
+	}
+	l.Modules = modules
+}
+
+// syncLockedModules makes pkg match the lock file exactly: installed packages that are not locked
+// are removed, and missing locked modules are installed at their locked version and hash.
+func syncLockedModules(t *Transaction, lock *LockFile) error {
+	local, err := getLocalPackages()
+	if err != nil {
+		return err
+	}
+	for _, p := range local {
+		if lock.Find(p.Name, p.Version.Original()) == nil {
+			err = removePlugin(t, p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, m := range lock.Modules {
+		if local.find(m.Path, m.Version) != nil {
+			continue
+		}
+		_, _, err = installModuleVersion(t, m.Path, m.Version, m.Hash)
+		if err != nil {
+			return err
+		}
+	}
+	return removeEmptyFolders(filepath.Join(PluginManagerRoot, "pkg"))
+}
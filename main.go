@@ -5,64 +5,230 @@ import (
 	"fmt"
 	"github.com/hashicorp/go-version"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/mod/module"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type Config struct {
+	// Source is an ordered list of proxies in GOPROXY format, e.g. "https://goproxy.cn,https://proxy.golang.org"
 	Source string `json:"source"`
+	// Routes send matching module paths to their own sources, the first matching route is used
+	Routes []SourceRoute `json:"routes"`
+	// Offline answers every lookup from the download cache only
+	Offline bool `json:"offline"`
+
+	// SumDB is the checksum database used to verify downloads, in GOSUMDB format: "sum.golang.org",
+	// "<name>+<hash>+<key> <url>" for a custom database, or "off"
+	SumDB string `json:"sumdb"`
+	// NoSumDB holds comma-separated glob patterns of module paths that are not checked against SumDB
+	NoSumDB string `json:"nosumdb"`
+
+	// Download controls retries and timeouts of downloads
+	Download DownloadConfig `json:"download"`
+	// Cache limits the size of the download cache
+	Cache CacheConfig `json:"cache"`
+	// Unzip limits the size of installed packages
+	Unzip UnzipLimits `json:"unzip"`
+
+	// Approved holds the script permissions the user approved for each plugin
+	Approved map[string]PluginPermissions `json:"approved,omitempty"`
+	// DeployMode is how the files declared in manifests are placed into plugins/: "copy" (default) or "symlink"
+	DeployMode string `json:"deployMode,omitempty"`
+	// Disabled holds the plugins turned off with the disable command
+	Disabled map[string]bool `json:"disabled,omitempty"`
 }
 
 var GlobalConfig Config
 
+// rootLock is held from Before to After
+var rootLock *RootLock
+
 func init() {
 	log.SetFlags(log.Ltime | log.Lshortfile)
-	initDirs()
-
-	configFilePath := filepath.Join(PluginManagerRoot, "PluginManager.json")
+}
 
-	_, err := os.Stat(configFilePath)
+// initConfig loads PluginManager.json, or writes the defaults if it doesn't exist
+func initConfig() error {
+	_, err := os.Stat(configFilePath())
 	if err != nil {
 		GlobalConfig.Source = DefaultDownloadSource
-		configData, err := json.MarshalIndent(GlobalConfig, "", "  ")
-		if err != nil {
-			log.Fatalln("WriteConfig", err)
-		}
-		file, err := os.Create(configFilePath)
-		if err != nil {
-			log.Fatalln("WriteConfig", err)
-		}
-		defer file.Close()
-		_, err = file.Write(configData)
-		if err != nil {
-			log.Fatalln("WriteConfig", err)
-		}
+		GlobalConfig.SumDB = DefaultSumDB
+		return saveConfig()
+	}
+	return loadConfig()
+}
 
-	} else {
-		data, err := os.Open(configFilePath)
-		if err != nil {
-			log.Fatalln("LoadConfig", err)
+// needsRoot reports whether the command in args works on PluginManagerRoot, help and test don't
+func needsRoot(args cli.Args) bool {
+	switch args.First() {
+	case "", "help", "h", "test":
+		return false
+	}
+	for _, arg := range args.Slice() {
+		if arg == "-h" || arg == "--help" {
+			return false
 		}
-		err = json.NewDecoder(data).Decode(&GlobalConfig)
-		if err != nil {
-			log.Fatalln("LoadConfig", err)
+	}
+	return true
+}
+
+// commandLockMode returns how the command in args locks PluginManagerRoot
+func commandLockMode(args cli.Args) LockMode {
+	switch args.First() {
+	case "serve":
+		// serve runs until it is stopped and would block every other command, the cache writes it does
+		// with --upstream are atomic
+		return LockNone
+	case "list", "outdated":
+		return LockShared
+	case "cache":
+		if args.Get(1) == "list" {
+			return LockShared
 		}
 	}
+	return LockExclusive
+}
+
+func configFilePath() string {
+	return filepath.Join(PluginManagerRoot, "PluginManager.json")
+}
+
+// loadConfig reads PluginManager.json into GlobalConfig
+func loadConfig() error {
+	data, err := os.Open(configFilePath())
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	config := Config{}
+	err = json.NewDecoder(data).Decode(&config)
+	if err != nil {
+		return err
+	}
+	err = validateSources(config)
+	if err != nil {
+		return fmt.Errorf("%s: %w", configFilePath(), err)
+	}
+	GlobalConfig = config
+	return nil
+}
+
+func saveConfig() error {
+	configData, err := json.MarshalIndent(GlobalConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(configFilePath(), configData, 0644)
+}
+
+func printPluginInfo(p PluginInfo) {
+	log.Println("Name\t", p.Name)
+	log.Println("Version\t", p.Version)
+	log.Println("Path\t", p.Path)
+	log.Println("State\t", pluginState(p.Name))
+	log.Printf("Manifest\t%+v", *p.Manifest)
+	log.Println("Require")
+	for k, v := range p.ModuleInfo.Require {
+		log.Printf("\t[%d] %s Indirect:%v", k, v.Mod, v.Indirect)
+	}
+	log.Print("\n")
 }
 
 func main() {
 	app := &cli.App{
 		Name:  "BDSLiteLoader Plugin Manager",
 		Usage: "BDSLiteLoader Plugin Manager that helps you download third-party plugins",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "output format: table, json or yaml",
+				Value:   OutputTable,
+			},
+			&cli.BoolFlag{
+				Name:  "offline",
+				Usage: "only use the download cache, never the network",
+			},
+			&cli.BoolFlag{
+				Name:    "yes",
+				Aliases: []string{"y"},
+				Usage:   "approve the permissions requested by plugins without asking",
+			},
+			&cli.StringFlag{
+				Name:    "root",
+				EnvVars: []string{RootEnv},
+				Usage:   "PluginManager directory inside of a server directory, found as plugins/PluginManager of the server directory above the working directory by default",
+			},
+			&cli.BoolFlag{
+				Name:  "wait",
+				Usage: "wait until other PluginManager processes are done with the plugins, the default",
+			},
+			&cli.BoolFlag{
+				Name:  "no-wait",
+				Usage: "fail at once if another PluginManager process is using the plugins",
+			},
+		},
+		Before: func(c *cli.Context) error {
+			err := setOutputFormat(c.String("output"))
+			if err != nil {
+				return err
+			}
+			if c.Bool("wait") && c.Bool("no-wait") {
+				return &UsageError{Message: "--wait and --no-wait cannot be used together"}
+			}
+			assumeYes = c.Bool("yes")
+			if machineOutput() {
+				// keep stdout clean for the records
+				scriptOutput = os.Stderr
+			}
+			if !needsRoot(c.Args()) {
+				return nil
+			}
+			ServerDir, PluginManagerRoot, err = resolveRoot(c.String("root"))
+			if err != nil {
+				return err
+			}
+			err = initDirs()
+			if err != nil {
+				return err
+			}
+			// an interrupted operation is finished or rolled back before the config is read,
+			// since the rollback restores it
+			rootLock, err = openRoot(commandLockMode(c.Args()), !c.Bool("no-wait"), strings.Join(c.Args().Slice(), " "))
+			if err != nil {
+				return err
+			}
+			err = initConfig()
+			if err != nil {
+				return err
+			}
+			offlineOverride = c.Bool("offline")
+			return nil
+		},
+		After: func(c *cli.Context) error {
+			return rootLock.Release()
+		},
 		Commands: []*cli.Command{
 
 			{
 				Name:  "test",
 				Usage: "test",
 				Action: func(c *cli.Context) error {
-					vm := newVmInstance()
-					_, err := vm.Run(`
+					wd, err := os.Getwd()
+					if err != nil {
+						return err
+					}
+					vm := newVmInstance(&vmSandbox{
+						PluginPath: filepath.Join(wd, "test"),
+						ServerRoot: wd,
+						Filesystem: []string{filepath.Join(wd, "test.txt")},
+						Commands:   []string{"cmd"},
+					})
+					_, err = vm.Run(`
 filesystem.Mkdir("./test");
 filesystem.Write("./test/test.txt", "test");
 console.log(filesystem.Exists("./test/test.txt"));
@@ -95,16 +261,46 @@ console.log(system.Cmd("cmd", "/C", "del", "test.txt"));
 								Value:       "github.com/WangYneos/GoModuleTest",
 								DefaultText: "github.com/WangYneos/GoModuleTest",
 							},
+							&cli.IntFlag{
+								Name:    "jobs",
+								Aliases: []string{"j"},
+								Usage:   "number of versions to fetch at the same time, defaults to download.concurrency",
+							},
 						},
 						Action: func(c *cli.Context) error {
-							versions, err := getModuleVersionList(c.String("url"), GlobalConfig.Source)
+							concurrency := c.Int("jobs")
+							if concurrency <= 0 {
+								concurrency = GlobalConfig.Download.withDefaults().Concurrency
+							}
+							versions, err := getModuleVersionList(c.String("url"), concurrency)
 							if err != nil {
 								return err
 							}
+							var list []string
 							for _, v := range versions {
-								log.Printf("%s\t%s\n", v.Version, v.Time)
+								list = append(list, v.Version)
 							}
-							return nil
+							// the versions are still worth listing without their retractions
+							status, err := getModuleStatus(c.String("url"), list)
+							if err != nil {
+								log.Printf("warning: could not check %s for retractions: %v", c.String("url"), err)
+							}
+							return printRecords(newVersionRecords(versions, status), func() {
+								if status.Deprecated != "" {
+									log.Printf("%s is deprecated: %s", c.String("url"), status.Deprecated)
+								}
+								for _, v := range versions {
+									if v.Err != nil {
+										log.Printf("%s\t-\t%v\n", v.Version, v.Err)
+										continue
+									}
+									if rationale, ok := status.retracted(v.Version); ok {
+										log.Printf("%s\t%s\t(retracted: %s)\n", v.Version, v.Time, rationale)
+										continue
+									}
+									log.Printf("%s\t%s\n", v.Version, v.Time)
+								}
+							})
 						},
 					},
 					{
@@ -117,20 +313,11 @@ console.log(system.Cmd("cmd", "/C", "del", "test.txt"));
 							if err != nil {
 								return err
 							}
-							for _, p := range plugins {
-								log.Println("Name\t", p.Name)
-								log.Println("Version\t", p.Version)
-								log.Println("Path\t", p.Path)
-								log.Printf("Manifest\t%+v", *p.Manifest)
-								log.Println("Require")
-								for k, v := range p.ModuleInfo.Require {
-									log.Printf("\t[%d] %s Indirect:%v", k, v.Mod, v.Indirect)
+							return printRecords(newPluginRecords(plugins), func() {
+								for _, p := range plugins {
+									printPluginInfo(p)
 								}
-
-								log.Print("\n")
-
-							}
-							return nil
+							})
 						},
 					},
 				},
@@ -149,50 +336,39 @@ console.log(system.Cmd("cmd", "/C", "del", "test.txt"));
 					&cli.StringFlag{
 						Name:        "version",
 						Aliases:     []string{"v"},
-						Usage:       "specify plugin version",
+						Usage:       "specify plugin version or query: @latest, @upgrade, @patch, v1, \">=v1.2 <v2\", a branch or a commit",
 						Value:       "@latest",
 						DefaultText: "@latest",
 					},
+					&cli.BoolFlag{
+						Name:  "prerelease",
+						Usage: "let version queries match pre-releases",
+					},
 				},
 				Action: func(c *cli.Context) error {
-					var err error
-
-					version := ModuleVersionInfo{}
-
-					if c.String("version") == "@latest" {
-						version, err = getModuleVersionLatest(c.String("url"), GlobalConfig.Source)
-						if err != nil {
-							log.Fatalf("failed to get latest version: %v", err)
-							return nil
-						}
-					} else {
-						version, err = getModuleVersionInfo(c.String("url"), GlobalConfig.Source, c.String("version"))
-						if err != nil {
-							log.Fatalf("failed to get version info for %s: %v", c.String("version"), err)
-							return nil
-						}
+					version, err := queryModuleVersion(c.String("url"), c.String("version"), c.Bool("prerelease"))
+					if err != nil {
+						return fmt.Errorf("failed to get version info for %s: %w", c.String("version"), err)
 					}
-					_, file := filepath.Split(c.String("url"))
-
-					log.Printf("downloading %s@%s [%v]", version.Version, c.String("url"), version.Time)
-					downloadUrl := getDownloadUrl(c.String("url"), GlobalConfig.Source, version.Version)
-					fileName := filepath.Join(PluginManagerRoot, "cache", fmt.Sprintf("%s-%s.zip", file, version.Version))
-					DownloadFile(fileName, downloadUrl)
-					path, err := UnzipModule(fileName, filepath.Join(PluginManagerRoot, "pkg"))
-					p, err := getPluginInfo(filepath.Join(PluginManagerRoot, "pkg", path))
+					graph, err := resolveDependencies(module.Version{Path: c.String("url"), Version: version.Version})
 					if err != nil {
 						return err
 					}
-					log.Println("Name\t", p.Name)
-					log.Println("Version\t", p.Version)
-					log.Println("Path\t", p.Path)
-					log.Printf("Manifest\t%+v", *p.Manifest)
-					log.Println("Require")
-					for k, v := range p.ModuleInfo.Require {
-						log.Printf("\t[%d] %s Indirect:%v", k, v.Mod, v.Indirect)
+					graph.Print()
+
+					var installed PluginInfos
+					err = inTransaction("download "+graph.Root.String(), func(t *Transaction) error {
+						installed, err = installBuildList(t, graph.BuildList, c.String("url"))
+						return err
+					})
+					if err != nil {
+						return err
 					}
-					log.Print("\n")
-					return err
+					return printRecords(newPluginRecords(installed), func() {
+						for _, p := range installed {
+							printPluginInfo(p)
+						}
+					})
 				},
 			},
 			{
@@ -213,6 +389,14 @@ console.log(system.Cmd("cmd", "/C", "del", "test.txt"));
 						Value:       "@all",
 						DefaultText: "@all",
 					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "remove even if other installed plugins require it",
+					},
+					&cli.BoolFlag{
+						Name:  "cascade",
+						Usage: "also remove the installed plugins that require it",
+					},
 				},
 				Action: func(c *cli.Context) error {
 					packages, err := getLocalPackages()
@@ -222,28 +406,362 @@ console.log(system.Cmd("cmd", "/C", "del", "test.txt"));
 
 					ver, err := version.NewVersion(c.String("version"))
 					if err != nil && c.String("version") != "@all" {
-						return err
+						return &UsageError{Message: err.Error()}
 					}
+					removed := PluginInfos{}
 					for _, v := range packages {
 						if v.Name == c.String("name") {
 							if c.String("version") == "@all" || v.Version.Equal(ver) {
-								log.Printf("Removing %s[%s]\n", v.Name, v.Version)
-								err := os.RemoveAll(filepath.Join(".", v.Path))
-								if err != nil {
-									return err
-								}
+								removed = append(removed, v)
 							}
 						}
 					}
-					err = removeEmptyFolders(filepath.Join(PluginManagerRoot, "pkg"))
-					return err
+					if len(removed) == 0 {
+						return &PluginNotFoundError{Name: c.String("name")}
+					}
+					if c.Bool("cascade") {
+						removed = withDependents(packages, removed)
+					} else if broken := brokenDependents(packages, removed); len(broken) > 0 && !c.Bool("force") {
+						return &DependentsError{Plugins: pluginNames(removed), Dependents: pluginNames(broken)}
+					}
+					err = inTransaction("remove "+strings.Join(pluginNames(removed), " "), func(t *Transaction) error {
+						return removePlugins(t, packages, removed)
+					})
+					if err != nil {
+						return err
+					}
+					return printRecords(newPluginRecords(removed), func() {})
+				},
+			},
+			{
+				Name:  "autoremove",
+				Usage: "remove plugins that were installed as dependencies and are no longer required",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "only print the plugins that would be removed",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					packages, err := getLocalPackages()
+					if err != nil {
+						return err
+					}
+					lock, err := loadLockFile()
+					if err != nil {
+						return err
+					}
+					orphans := orphanedDependencies(packages, lock)
+					if !c.Bool("dry-run") {
+						err = inTransaction("autoremove", func(t *Transaction) error {
+							return removePlugins(t, packages, orphans)
+						})
+						if err != nil {
+							return err
+						}
+					}
+					return printRecords(newPluginRecords(orphans), func() {
+						for _, p := range orphans {
+							log.Printf("%s\t%s", p.Name, p.Version.Original())
+						}
+					})
+				},
+			},
+			{
+				Name:      "upgrade",
+				Usage:     "upgrade installed plugins within semver constraints",
+				ArgsUsage: "[name...]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "all",
+						Usage: "upgrade every installed plugin",
+					},
+					&cli.BoolFlag{
+						Name:  "patch",
+						Usage: "only upgrade to newer patch versions",
+					},
+					&cli.BoolFlag{
+						Name:  "minor",
+						Usage: "upgrade to newer minor or patch versions (default)",
+					},
+					&cli.BoolFlag{
+						Name:  "major",
+						Usage: "also upgrade to newer major versions",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "only print the upgrades",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 && !c.Bool("all") {
+						return &UsageError{Message: "specify plugin names or --all"}
+					}
+					limit := UpgradeMinor
+					var limitFlags []string
+					for _, f := range []struct {
+						name  string
+						limit UpgradeLimit
+					}{{"patch", UpgradePatch}, {"minor", UpgradeMinor}, {"major", UpgradeMajor}} {
+						if c.Bool(f.name) {
+							limit = f.limit
+							limitFlags = append(limitFlags, "--"+f.name)
+						}
+					}
+					if len(limitFlags) > 1 {
+						return &UsageError{Message: strings.Join(limitFlags, ", ") + " cannot be used together"}
+					}
+
+					upgrades, err := planUpgrades(c.Args().Slice(), limit)
+					if err != nil {
+						return err
+					}
+					if len(upgrades) == 0 {
+						log.Println("everything is up to date")
+						return nil
+					}
+					for _, u := range upgrades {
+						log.Printf("%s\t%s -> %s", u.Plugin.Name, u.From, u.To)
+					}
+					if c.Bool("dry-run") {
+						return nil
+					}
+					for _, u := range upgrades {
+						err = inTransaction("upgrade "+u.Plugin.Name+" "+u.From+" to "+u.To, func(t *Transaction) error {
+							return upgradePlugin(t, u)
+						})
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "outdated",
+				Usage: "list installed plugins that have newer versions",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the report as json",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					plugins, err := newestLocalPackages()
+					if err != nil {
+						return err
+					}
+					if c.Bool("json") {
+						outputFormat = OutputJson
+					}
+					outdated := checkOutdated(plugins)
+					if outdated == nil {
+						outdated = []OutdatedPlugin{}
+					}
+					return printRecords(outdated, func() {
+						log.Println("Name\tCurrent\tWanted\tLatest")
+						for _, p := range outdated {
+							if p.Error != "" {
+								log.Printf("%s\t%s\t-\t-\t%s", p.Name, p.Current, p.Error)
+								continue
+							}
+							log.Printf("%s\t%s\t%s\t%s", p.Name, p.Current, p.Wanted, p.Latest)
+							if p.Retracted != "" {
+								log.Printf("\t%s is retracted: %s", p.Current, p.Retracted)
+							}
+							if p.Deprecated != "" {
+								log.Printf("\t%s is deprecated: %s", p.Name, p.Deprecated)
+							}
+						}
+					})
+				},
+			},
+			{
+				Name:  "cache",
+				Usage: "manage the download cache",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "list cached module versions, least recently used first",
+						Action: func(c *cli.Context) error {
+							entries, err := listCacheEntries()
+							if err != nil {
+								return err
+							}
+							if entries == nil {
+								entries = []CacheEntry{}
+							}
+							return printRecords(entries, func() {
+								printCacheEntries(entries)
+							})
+						},
+					},
+					{
+						Name:  "verify",
+						Usage: "check cached zips against their recorded hashes, quarantining mismatches",
+						Action: func(c *cli.Context) error {
+							entries, err := listCacheEntries()
+							if err != nil {
+								return err
+							}
+							lock, err := loadLockFile()
+							if err != nil {
+								return err
+							}
+							var failed error
+							count := 0
+							for _, e := range entries {
+								if err := verifyCacheEntry(e, lock); err != nil {
+									log.Println(err)
+									failed = err
+									count++
+								}
+							}
+							if failed != nil {
+								return fmt.Errorf("%d of %d cached entries failed verification, last error: %w", count, len(entries), failed)
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "clean",
+						Usage: "remove cached module versions",
+						Flags: []cli.Flag{
+							&cli.DurationFlag{
+								Name:  "older-than",
+								Usage: "only remove entries not used for this long, e.g. 720h",
+							},
+							&cli.Uint64Flag{
+								Name:  "max-size",
+								Usage: "remove least recently used entries until the cache is at most this many bytes",
+							},
+							&cli.BoolFlag{
+								Name:  "all",
+								Usage: "remove every entry",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							set := 0
+							for _, name := range []string{"older-than", "max-size", "all"} {
+								if c.IsSet(name) {
+									set++
+								}
+							}
+							if set != 1 {
+								return &UsageError{Message: "cache clean needs exactly one of --older-than, --max-size or --all"}
+							}
+							var removed []CacheEntry
+							var err error
+							switch {
+							case c.IsSet("max-size"):
+								removed, err = evictCache(c.Uint64("max-size"))
+							case c.Bool("all"):
+								removed, err = cleanCache(0)
+							default:
+								if c.Duration("older-than") <= 0 {
+									return &UsageError{Message: "--older-than must be positive"}
+								}
+								removed, err = cleanCache(c.Duration("older-than"))
+							}
+							if err != nil {
+								return err
+							}
+							if removed == nil {
+								removed = []CacheEntry{}
+							}
+							return printRecords(removed, func() {
+								for _, e := range removed {
+									log.Printf("removed %s", e)
+								}
+							})
+						},
+					},
+				},
+			},
+			{
+				Name:  "sync",
+				Usage: "install exactly the plugins recorded in PluginManager.lock",
+				Action: func(c *cli.Context) error {
+					lock, err := loadLockFile()
+					if err != nil {
+						return err
+					}
+					return inTransaction("sync", func(t *Transaction) error {
+						return syncLockedModules(t, lock)
+					})
+				},
+			},
+			{
+				Name:      "enable",
+				Usage:     "turn a disabled plugin back on",
+				ArgsUsage: "<name>",
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return &UsageError{Message: "enable needs the name of one plugin"}
+					}
+					var plugins PluginInfos
+					err := inTransaction("enable "+c.Args().First(), func(t *Transaction) error {
+						var err error
+						plugins, err = setPluginEnabled(t, c.Args().First(), true)
+						return err
+					})
+					if err != nil {
+						return err
+					}
+					return printRecords(newPluginRecords(plugins), func() {})
+				},
+			},
+			{
+				Name:      "disable",
+				Usage:     "turn a plugin off without uninstalling it, the package stays in pkg",
+				ArgsUsage: "<name>",
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return &UsageError{Message: "disable needs the name of one plugin"}
+					}
+					var plugins PluginInfos
+					err := inTransaction("disable "+c.Args().First(), func(t *Transaction) error {
+						var err error
+						plugins, err = setPluginEnabled(t, c.Args().First(), false)
+						return err
+					})
+					if err != nil {
+						return err
+					}
+					return printRecords(newPluginRecords(plugins), func() {})
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "serve the download cache as a GOPROXY for other servers",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "addr",
+						Value: ":8080",
+						Usage: "address to listen on",
+					},
+					&cli.BoolFlag{
+						Name:  "upstream",
+						Usage: "fetch modules missing from the cache from the configured source and store them",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if !c.Bool("upstream") {
+						offlineOverride = true
+					}
+					log.Printf("serving %s on %s", cacheDir(), c.String("addr"))
+					return http.ListenAndServe(c.String("addr"), logRequests(newProxyHandler()))
 				},
 			},
 		},
 	}
 
+	app.OnUsageError = onUsageError
+	setUsageErrorHandlers(app.Commands)
+
 	err := app.Run(os.Args)
 	if err != nil {
-		log.Fatal(err)
+		printError(err)
+		os.Exit(exitCode(err))
 	}
 }
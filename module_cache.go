@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// CacheConfig limits the download cache, zero values mean no limit
+type CacheConfig struct {
+	MaxSize uint64 `json:"maxSize"` // bytes, least recently used entries are evicted above it
+}
+
+// The download cache uses the GOPROXY layout: cache/download/<escaped module>/@v/<version>.{info,mod,zip,ziphash}
+func cacheDir() string {
+	return filepath.Join(PluginManagerRoot, "cache", "download")
+}
+
+func cacheFile(modulePath, versionStr, ext string) (string, error) {
+	file, err := moduleFileUrl(modulePath, versionStr, ext)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir(), filepath.FromSlash(file)), nil
+}
+
+func readCacheFile(modulePath, versionStr, ext string) ([]byte, error) {
+	fileName, err := cacheFile(modulePath, versionStr, ext)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(fileName)
+}
+
+// writeCacheFile writes the file through a temporary file, so readers never see a partial file
+func writeCacheFile(modulePath, versionStr, ext string, data []byte) error {
+	target, err := cacheFile(modulePath, versionStr, ext)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = replaceCacheFile(target, data)
+	if err != nil {
+		return err
+	}
+	if ext == ".info" {
+		return updateCacheList(modulePath, versionStr, true)
+	}
+	return nil
+}
+
+// replaceCacheFile writes data to a temporary file of its own and renames it to target. Other
+// PluginManager processes fill the cache too, so the temporary name must not be shared.
+func replaceCacheFile(target string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), target)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// cacheLockPollInterval is short, a cache lock is only held while one file is filled
+const cacheLockPollInterval = 50 * time.Millisecond
+
+// lockCacheFile locks fileName against other PluginManager processes and returns the function that
+// unlocks it. list remote, outdated and serve fill the cache without the exclusive root lock.
+// Like the root lock, a lock whose process no longer runs is stale.
+func lockCacheFile(fileName string) (func(), error) {
+	path := fileName + ".lock"
+	own := LockOwner{PID: os.Getpid(), Command: "cache", Since: time.Now()}
+	for {
+		owner, err := createLockFile(path, own)
+		if err != nil {
+			return nil, err
+		}
+		if owner == nil {
+			return func() { os.Remove(path) }, nil
+		}
+		time.Sleep(cacheLockPollInterval)
+	}
+}
+
+// cacheListLock serializes updates of the @v/list files in this process, versions are fetched in
+// parallel, the lock file of the list serializes them with other processes
+var cacheListLock sync.Mutex
+
+// updateCacheList adds or removes the version in the @v/list file of the module,
+// so the cache can be used as a GOPROXY
+func updateCacheList(modulePath, versionStr string, add bool) error {
+	cacheListLock.Lock()
+	defer cacheListLock.Unlock()
+	fileName, err := cacheFile(modulePath, versionStr, "")
+	if err != nil {
+		return err
+	}
+	listFile := filepath.Join(filepath.Dir(fileName), "list")
+	err = os.MkdirAll(filepath.Dir(listFile), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockCacheFile(listFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	data, err := ioutil.ReadFile(listFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var versions []string
+	found := false
+	for _, v := range strings.Split(string(data), "\n") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if v == versionStr {
+			found = true
+			if !add {
+				continue
+			}
+		}
+		versions = append(versions, v)
+	}
+	if add == found {
+		return nil
+	}
+	if add {
+		versions = append(versions, versionStr)
+	}
+	semver.Sort(versions)
+	content := ""
+	for _, v := range versions {
+		content += v + "\n"
+	}
+	return replaceCacheFile(listFile, []byte(content))
+}
+
+// touchCacheEntry marks the entry as used, for the least recently used eviction
+func touchCacheEntry(modulePath, versionStr string) {
+	if fileName, err := cacheFile(modulePath, versionStr, ".zip"); err == nil {
+		now := time.Now()
+		os.Chtimes(fileName, now, now)
+	}
+}
+
+// cachedModuleZip returns the cached zip of the module version and its hash, if the zip still matches
+// the hash recorded when it was downloaded. A zip that doesn't match is quarantined.
+func cachedModuleZip(modulePath, versionStr string) (fileName string, hash string, ok bool) {
+	fileName, err := cacheFile(modulePath, versionStr, ".zip")
+	if err != nil {
+		return "", "", false
+	}
+	recorded, err := readCacheFile(modulePath, versionStr, ".ziphash")
+	if err != nil {
+		return "", "", false
+	}
+	if _, err = os.Stat(fileName); err != nil {
+		return "", "", false
+	}
+	hash, err = dirhash.HashZip(fileName, dirhash.Hash1)
+	if err != nil || hash != strings.TrimSpace(string(recorded)) {
+		log.Printf("cached %s@%s is corrupted, downloading it again", modulePath, versionStr)
+		if qErr := quarantineCacheFile(fileName); qErr != nil {
+			log.Println(qErr)
+		}
+		return "", "", false
+	}
+	touchCacheEntry(modulePath, versionStr)
+	return fileName, hash, true
+}
+
+type CacheEntry struct {
+	Path     string    `json:"path" yaml:"path"`
+	Version  string    `json:"version" yaml:"version"`
+	Size     int64     `json:"size" yaml:"size"`
+	LastUsed time.Time `json:"lastUsed" yaml:"lastUsed"`
+	Files    []string  `json:"files" yaml:"files"`
+}
+
+// listCacheEntries returns every cached module version, least recently used first
+func listCacheEntries() ([]CacheEntry, error) {
+	var entries []CacheEntry
+	err := filepath.Walk(cacheDir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() || info.Name() != "@v" {
+			return nil
+		}
+		rel, err := filepath.Rel(cacheDir(), filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		modulePath, err := module.UnescapePath(filepath.ToSlash(rel))
+		if err != nil {
+			log.Printf("skipping %s: %v", path, err)
+			return filepath.SkipDir
+		}
+
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		versions := map[string]*CacheEntry{}
+		var order []string
+		for _, f := range files {
+			ext := filepath.Ext(f.Name())
+			if f.IsDir() || ext == ".tmp" || ext == ".validator" || ext == ".lock" || f.Name() == "list" {
+				continue
+			}
+			v, err := unescapeModuleVersion(strings.TrimSuffix(f.Name(), ext))
+			if err != nil {
+				log.Printf("skipping %s: %v", filepath.Join(path, f.Name()), err)
+				continue
+			}
+			e, ok := versions[v]
+			if !ok {
+				e = &CacheEntry{Path: modulePath, Version: v}
+				versions[v] = e
+				order = append(order, v)
+			}
+			e.Size += f.Size()
+			e.Files = append(e.Files, f.Name())
+			if f.ModTime().After(e.LastUsed) {
+				e.LastUsed = f.ModTime()
+			}
+		}
+		for _, v := range order {
+			entries = append(entries, *versions[v])
+		}
+		return filepath.SkipDir
+	})
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+	return entries, err
+}
+
+// removeCacheEntry removes the files of the entry, waiting for a fill of its zip in another process
+func removeCacheEntry(e CacheEntry) error {
+	zipFile, err := cacheFile(e.Path, e.Version, ".zip")
+	if err != nil {
+		return err
+	}
+	unlock, err := lockCacheFile(zipFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, f := range e.Files {
+		fileName, err := cacheFile(e.Path, e.Version, filepath.Ext(f))
+		if err != nil {
+			return err
+		}
+		err = os.Remove(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return updateCacheList(e.Path, e.Version, false)
+}
+
+// verifyCacheEntry rehashes the cached zip and compares it with the hash recorded on download
+// and the hash in the lock file. A zip that doesn't match is quarantined.
+func verifyCacheEntry(e CacheEntry, lock *LockFile) error {
+	fileName, err := cacheFile(e.Path, e.Version, ".zip")
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil
+	}
+	hash, err := dirhash.HashZip(fileName, dirhash.Hash1)
+	if err != nil {
+		return err
+	}
+	m := module.Version{Path: e.Path, Version: e.Version}
+	var mismatch error
+	if recorded, err := readCacheFile(e.Path, e.Version, ".ziphash"); err == nil && strings.TrimSpace(string(recorded)) != hash {
+		mismatch = &ChecksumMismatchError{Module: m, File: "zip", Downloaded: hash, Expected: strings.TrimSpace(string(recorded)), Source: "cached"}
+	} else if locked := lock.Find(e.Path, e.Version); locked != nil && locked.Hash != hash {
+		mismatch = &ChecksumMismatchError{Module: m, File: "zip", Downloaded: hash, Expected: locked.Hash, Source: "locked"}
+	}
+	if mismatch != nil {
+		if err := quarantineCacheFile(fileName); err != nil {
+			log.Println(err)
+		}
+	}
+	return mismatch
+}
+
+// cleanCache removes the entries that were not used for longer than olderThan, every entry if it is zero
+func cleanCache(olderThan time.Duration) (removed []CacheEntry, err error) {
+	entries, err := listCacheEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if olderThan > 0 && time.Since(e.LastUsed) < olderThan {
+			continue
+		}
+		if err = removeCacheEntry(e); err != nil {
+			return
+		}
+		removed = append(removed, e)
+	}
+	return removed, removeEmptyFolders(cacheDir())
+}
+
+// evictCache removes the least recently used entries until the cache is not larger than maxSize.
+// The entries of keep are never removed, even if they alone are larger.
+func evictCache(maxSize uint64, keep ...module.Version) (removed []CacheEntry, err error) {
+	entries, err := listCacheEntries()
+	if err != nil {
+		return nil, err
+	}
+	var total uint64
+	for _, e := range entries {
+		total += uint64(e.Size)
+	}
+	for _, e := range entries {
+		if total <= maxSize {
+			break
+		}
+		if containsModule(keep, e.Path, e.Version) {
+			continue
+		}
+		if err = removeCacheEntry(e); err != nil {
+			return
+		}
+		total -= uint64(e.Size)
+		removed = append(removed, e)
+	}
+	return removed, removeEmptyFolders(cacheDir())
+}
+
+func containsModule(list []module.Version, modulePath, versionStr string) bool {
+	for _, m := range list {
+		if m.Path == modulePath && m.Version == versionStr {
+			return true
+		}
+	}
+	return false
+}
+
+func printCacheEntries(entries []CacheEntry) {
+	for _, e := range entries {
+		log.Printf("%s@%s\t%d bytes\t%s\t%s", e.Path, e.Version, e.Size, e.LastUsed.Format(time.RFC3339), strings.Join(e.Files, ","))
+	}
+}
+
+func (e CacheEntry) String() string {
+	return fmt.Sprintf("%s@%s", e.Path, e.Version)
+}
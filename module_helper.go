@@ -3,145 +3,485 @@ package main
 import (
 	"archive/zip"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 )
 
 type ModuleVersionInfo struct {
 	Version string    // version string
 	Time    time.Time // commit time
+
+	// Err is set by getModuleVersionList if the info of this version could not be fetched
+	Err error `json:"-"`
 }
 
-func escapeModuleUrl(url string) (ret string) {
-	for _, v := range url {
-		if v > 'A' && v < 'Z' {
-			ret += "!"
-			ret += string(v + 32)
-		} else {
-			ret += string(v)
-		}
+// escapeModuleUrl validates the module path and escapes it for proxy urls and cache directories:
+// every upper case letter becomes "!" and its lower case, e.g. "github.com/Zed/Addon" becomes
+// "github.com/!zed/!addon", so paths that only differ in case don't collide on case-insensitive file systems
+func escapeModuleUrl(modulePath string) (string, error) {
+	return module.EscapePath(modulePath)
+}
+
+// unescapeModuleUrl reverses escapeModuleUrl
+func unescapeModuleUrl(escaped string) (string, error) {
+	return module.UnescapePath(escaped)
+}
+
+// escapeModuleVersion validates the version and escapes it like escapeModuleUrl
+func escapeModuleVersion(versionStr string) (string, error) {
+	return module.EscapeVersion(versionStr)
+}
+
+// unescapeModuleVersion reverses escapeModuleVersion
+func unescapeModuleVersion(escaped string) (string, error) {
+	return module.UnescapeVersion(escaped)
+}
+
+// moduleFileUrl returns the path of a file of the module version relative to the proxy root,
+// "<escaped module>/@v/<escaped version><ext>"
+func moduleFileUrl(modulePath, versionStr, ext string) (string, error) {
+	escapedPath, err := escapeModuleUrl(modulePath)
+	if err != nil {
+		return "", err
 	}
-	return
+	escapedVersion, err := escapeModuleVersion(versionStr)
+	if err != nil {
+		return "", err
+	}
+	return escapedPath + "/@v/" + escapedVersion + ext, nil
+}
+
+// HttpStatusError is returned when a source answers with a status other than 200 OK
+type HttpStatusError struct {
+	Url        string
+	StatusCode int
+}
+
+func (e *HttpStatusError) Error() string {
+	return fmt.Sprintf("get %s failed, status code: %d", e.Url, e.StatusCode)
+}
+
+// isNotFound reports whether err means the source does not have the requested module or version.
+// Local I/O errors are not, even if a file does not exist.
+func isNotFound(err error) bool {
+	var statusErr *HttpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusGone
+	}
+	var noMatchErr *NoMatchingVersionError
+	return errors.As(err, &noMatchErr)
 }
 
-func getDownloadUrl(modulePath, goproxyUrl, versionStr string) string {
-	return fmt.Sprintf("%s/%s/@v/%s.zip", goproxyUrl, escapeModuleUrl(modulePath), versionStr)
+// fileSourceError makes a missing file of a file:// source a 404, like an http source answers
+func fileSourceError(fileUrl string, err error) error {
+	if os.IsNotExist(err) {
+		return &HttpStatusError{Url: fileUrl, StatusCode: http.StatusNotFound}
+	}
+	return err
 }
 
-func getModuleVersionInfo(modulePath, goproxyUrl, versionStr string) (ret ModuleVersionInfo, err error) {
-	url := fmt.Sprintf("%s/%s/@v/%s.info", goproxyUrl, escapeModuleUrl(modulePath), versionStr)
-	resp, err := http.Get(url)
+func httpGetBytes(url string) ([]byte, error) {
+	resp, err := httpClient().Get(url)
 	if err != nil {
-		return
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		err = fmt.Errorf("get module version info failed, status code: %d", resp.StatusCode)
+		return nil, &HttpStatusError{Url: url, StatusCode: resp.StatusCode}
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// fileUrlPath returns the local path of a file:// url
+func fileUrlPath(fileUrl string) (string, bool) {
+	if !strings.HasPrefix(fileUrl, "file://") {
+		return "", false
+	}
+	u, err := url.Parse(fileUrl)
+	if err != nil {
+		return "", false
+	}
+	path := u.Path
+	// file:///C:/dir on windows
+	if len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return filepath.FromSlash(path), true
+}
+
+// pathToFileUrl is the reverse of fileUrlPath
+func pathToFileUrl(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	abs = filepath.ToSlash(abs)
+	if !strings.HasPrefix(abs, "/") {
+		abs = "/" + abs
+	}
+	return "file://" + abs, nil
+}
+
+// fetchUrl reads an http(s) or file:// url
+func fetchUrl(rawUrl string) ([]byte, error) {
+	if path, ok := fileUrlPath(rawUrl); ok {
+		data, err := ioutil.ReadFile(path)
+		return data, fileSourceError(rawUrl, err)
+	}
+	return httpGetBytes(rawUrl)
+}
+
+// proxyGet fetches path, relative to the proxy root, from the sources configured for modulePath
+func proxyGet(modulePath, path string) (data []byte, err error) {
+	err = fetchFromSources(modulePath, func(goproxyUrl string) error {
+		data, err = fetchUrl(goproxyUrl + "/" + path)
+		return err
+	})
+	return
+}
+
+func getDownloadUrl(modulePath, goproxyUrl, versionStr string) (string, error) {
+	file, err := moduleFileUrl(modulePath, versionStr, ".zip")
+	if err != nil {
+		return "", err
+	}
+	return goproxyUrl + "/" + file, nil
+}
+
+// downloadModuleZip downloads the zip of the module version to fileName from the sources configured for modulePath
+func downloadModuleZip(modulePath, versionStr, fileName string) error {
+	return fetchFromSources(modulePath, func(goproxyUrl string) error {
+		downloadUrl, err := getDownloadUrl(modulePath, goproxyUrl, versionStr)
+		if err != nil {
+			return err
+		}
+		if path, ok := fileUrlPath(downloadUrl); ok {
+			return fileSourceError(downloadUrl, copyLocalFile(path, fileName))
+		}
+		return DownloadFile(fileName, downloadUrl)
+	})
+}
+
+// getModuleVersionInfo returns the info of the module version from the cache, or fetches and caches it
+func getModuleVersionInfo(modulePath, versionStr string) (ret ModuleVersionInfo, err error) {
+	if data, err := readCacheFile(modulePath, versionStr, ".info"); err == nil && json.Unmarshal(data, &ret) == nil {
+		return ret, nil
+	}
+	file, err := moduleFileUrl(modulePath, versionStr, ".info")
+	if err != nil {
+		return
+	}
+	data, err := proxyGet(modulePath, file)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &ret)
+	if err != nil {
 		return
 	}
-	err = json.NewDecoder(resp.Body).Decode(&ret)
+	// versionStr may be a query like a branch name, cache the info under the resolved version
+	if ret.Version == versionStr {
+		err = writeCacheFile(modulePath, versionStr, ".info", data)
+	}
 	return
 }
 
-func getModuleVersionLatest(modulePath string, goproxyUrl string) (ver ModuleVersionInfo, err error) {
-	realUrl := fmt.Sprintf("%s/%s/@latest", goproxyUrl, escapeModuleUrl(modulePath))
-	resp, err := http.Get(realUrl)
+// getModuleVersionLatest returns the highest version in the version list that is not retracted.
+// Only a module without any tagged version is resolved by the @latest endpoint, usually to a pseudo-version.
+func getModuleVersionLatest(modulePath string) (ver ModuleVersionInfo, err error) {
+	versions, status, err := getModuleVersionsStatus(modulePath)
+	if err != nil && !isNotFound(err) {
+		return
+	}
+	if latest := latestVersion(versions); latest != "" {
+		return getModuleVersionInfo(modulePath, latest)
+	}
+	if len(status.Retract) > 0 {
+		return ver, &NoMatchingVersionError{Path: modulePath, Query: "latest"}
+	}
+
+	escapedPath, err := escapeModuleUrl(modulePath)
 	if err != nil {
 		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		err = fmt.Errorf("get module version list failed, status code: %d", resp.StatusCode)
+	data, err := proxyGet(modulePath, escapedPath+"/@latest")
+	if err != nil {
 		return
 	}
-	err = json.NewDecoder(resp.Body).Decode(&ver)
+	err = json.Unmarshal(data, &ver)
 	return
 }
 
-func getModuleVersionList(modulePath string, goproxyUrl string) (list []ModuleVersionInfo, err error) {
-	realUrl := fmt.Sprintf("%s/%s/@v/list", goproxyUrl, escapeModuleUrl(modulePath))
-	resp, err := http.Get(realUrl)
+// latestVersion returns the highest release version, or the highest pre-release if there is no release
+func latestVersion(versions []string) string {
+	latest, latestPre := "", ""
+	for _, v := range versions {
+		if !semver.IsValid(v) {
+			continue
+		}
+		if semver.Prerelease(v) == "" {
+			if latest == "" || semver.Compare(v, latest) > 0 {
+				latest = v
+			}
+		} else if latestPre == "" || semver.Compare(v, latestPre) > 0 {
+			latestPre = v
+		}
+	}
+	if latest == "" {
+		return latestPre
+	}
+	return latest
+}
+
+// getModuleGoMod returns the go.mod of the module version from the cache, or fetches and caches it
+func getModuleGoMod(modulePath, versionStr string) (*modfile.File, error) {
+	data, err := readCacheFile(modulePath, versionStr, ".mod")
 	if err != nil {
-		return nil, err
+		var file string
+		file, err = moduleFileUrl(modulePath, versionStr, ".mod")
+		if err != nil {
+			return nil, err
+		}
+		data, err = proxyGet(modulePath, file)
+		if err != nil {
+			return nil, err
+		}
+		err = writeCacheFile(modulePath, versionStr, ".mod", data)
+		if err != nil {
+			return nil, err
+		}
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("get module version list failed, status code: %d", resp.StatusCode)
+	return modfile.ParseLax(modulePath+"@"+versionStr+"/go.mod", data, nil)
+}
+
+// getModuleVersions returns the known versions of the module in semver order, without fetching their info
+func getModuleVersions(modulePath string) (versions []string, err error) {
+	escapedPath, err := escapeModuleUrl(modulePath)
+	if err != nil {
+		return nil, err
 	}
-	data, err := io.ReadAll(resp.Body)
+	data, err := proxyGet(modulePath, escapedPath+"/@v/list")
 	if err != nil {
 		return nil, err
 	}
-	versions := strings.Split(string(data), "\n")
-	for _, v := range versions {
-		if v != "" {
-			ver, err := getModuleVersionInfo(modulePath, goproxyUrl, v)
-			if err != nil {
-				return nil, err
-			}
-			list = append(list, ver)
+	for _, v := range strings.Split(string(data), "\n") {
+		if v = strings.TrimSpace(v); v != "" {
+			versions = append(versions, v)
 		}
 	}
+	semver.Sort(versions)
 	return
 }
-func UnzipModule(src, dest string) (string, error) {
+
+// getModuleVersionList fetches the info of every version of the module, up to concurrency at a time.
+// A version whose info can't be fetched is still returned, with Err set.
+func getModuleVersionList(modulePath string, concurrency int) ([]ModuleVersionInfo, error) {
+	versions, err := getModuleVersions(modulePath)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]ModuleVersionInfo, len(versions))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(versions); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range jobs {
+				info, err := getModuleVersionInfo(modulePath, versions[k])
+				if err != nil {
+					info = ModuleVersionInfo{Version: versions[k], Err: err}
+				}
+				list[k] = info
+			}
+		}()
+	}
+	for k := range versions {
+		jobs <- k
+	}
+	close(jobs)
+	wg.Wait()
+	return list, nil
+}
+
+// UnzipLimits protect UnzipModule against zip bombs, zero values use the defaults
+type UnzipLimits struct {
+	MaxTotalSize uint64 `json:"maxTotalSize"` // total uncompressed bytes
+	MaxFiles     int    `json:"maxFiles"`
+	MaxRatio     uint64 `json:"maxRatio"` // uncompressed size / compressed size of a single file
+}
+
+const (
+	DefaultUnzipMaxTotalSize = 500 << 20 // same as the limit of Go module zips
+	DefaultUnzipMaxFiles     = 10000
+	DefaultUnzipMaxRatio     = 100
+)
+
+func (l UnzipLimits) withDefaults() UnzipLimits {
+	if l.MaxTotalSize == 0 {
+		l.MaxTotalSize = DefaultUnzipMaxTotalSize
+	}
+	if l.MaxFiles == 0 {
+		l.MaxFiles = DefaultUnzipMaxFiles
+	}
+	if l.MaxRatio == 0 {
+		l.MaxRatio = DefaultUnzipMaxRatio
+	}
+	return l
+}
+
+// UnsafeZipEntryError is returned by UnzipModule for a zip entry that is refused
+type UnsafeZipEntryError struct {
+	Zip    string
+	Entry  string
+	Reason string
+}
+
+func (e *UnsafeZipEntryError) Error() string {
+	return fmt.Sprintf("%s: unsafe entry %q: %s", e.Zip, e.Entry, e.Reason)
+}
+
+// NotPluginError is returned by UnzipModule for a module without manifest.json, like a Go library
+// that a plugin's go.mod requires
+type NotPluginError struct {
+	Module module.Version
+}
+
+func (e *NotPluginError) Error() string {
+	return fmt.Sprintf("%s is not a plugin: no manifest.json found in zip file", e.Module)
+}
+
+// checkZipEntry rejects entries that would be written outside of dest, symlinks and suspiciously compressed files
+func checkZipEntry(f *zip.File, name, dest string, limits UnzipLimits) string {
+	if strings.ContainsAny(f.Name, `\:`) {
+		return "invalid character in path"
+	}
+	path, err := filepath.Abs(filepath.Join(dest, name))
+	if err != nil || !isWithin(path, dest) {
+		return "path is outside of the destination"
+	}
+	if f.Mode()&os.ModeSymlink != 0 {
+		return "symlinks are not allowed"
+	}
+	if !f.Mode().IsDir() && !f.Mode().IsRegular() {
+		return "not a regular file"
+	}
+	if f.UncompressedSize64 > 0 && f.CompressedSize64 == 0 ||
+		f.CompressedSize64 > 0 && f.UncompressedSize64/f.CompressedSize64 > limits.MaxRatio {
+		return fmt.Sprintf("compression ratio exceeds %d", limits.MaxRatio)
+	}
+	return ""
+}
+
+func extractZipFile(f *zip.File, path string, maxSize uint64) (written uint64, err error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return 0, err
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode().Perm()|0600)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	// the sizes in the zip header can lie, so never copy more than allowed
+	n, err := io.Copy(out, io.LimitReader(rc, int64(maxSize)+1))
+	return uint64(n), err
+}
+
+func UnzipModule(src, dest string, m module.Version) (string, error) {
 	var path string
 	r, err := zip.OpenReader(src)
 	if err != nil {
 		return "", err
 	}
 	defer r.Close()
-	hasManifest := false
 
-	for _, f := range r.File {
+	// the files of a module zip are in "<module>@<version>/", they are extracted into the escaped
+	// directory instead, so modules that only differ in case don't collide
+	prefix := m.Path + "@" + m.Version + "/"
+	escapedPath, err := escapeModuleUrl(m.Path)
+	if err != nil {
+		return "", err
+	}
+	escapedVersion, err := escapeModuleVersion(m.Version)
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, len(r.File))
+	for k, f := range r.File {
+		if !strings.HasPrefix(f.Name, prefix) {
+			return "", &UnsafeZipEntryError{Zip: src, Entry: f.Name, Reason: fmt.Sprintf("not in %s", prefix)}
+		}
+		names[k] = escapedPath + "@" + escapedVersion + "/" + strings.TrimPrefix(f.Name, prefix)
+	}
+
+	hasManifest := false
+	for k, f := range r.File {
 		var filename string
-		path, filename = filepath.Split(f.Name)
+		path, filename = filepath.Split(names[k])
 		if !f.FileInfo().IsDir() && filename == "manifest.json" {
 			hasManifest = true
 			break
 		}
 	}
 	if !hasManifest {
-		return "", fmt.Errorf("no manifest.json found in zip file")
+		return "", &NotPluginError{Module: m}
 	}
-	for _, f := range r.File {
-		rc, err := f.Open()
-		if err != nil {
-			return "", err
+
+	limits := GlobalConfig.Unzip.withDefaults()
+	if len(r.File) > limits.MaxFiles {
+		return "", &UnsafeZipEntryError{Zip: src, Entry: r.File[limits.MaxFiles].Name, Reason: fmt.Sprintf("more than %d files", limits.MaxFiles)}
+	}
+	absDest, err := filepath.Abs(dest)
+	if err != nil {
+		return "", err
+	}
+	for k, f := range r.File {
+		if reason := checkZipEntry(f, names[k], absDest, limits); reason != "" {
+			return "", &UnsafeZipEntryError{Zip: src, Entry: f.Name, Reason: reason}
 		}
-		defer rc.Close()
+	}
 
-		path := filepath.Join(dest, f.Name)
+	var total uint64
+	for k, f := range r.File {
+		path := filepath.Join(dest, names[k])
 		if f.FileInfo().IsDir() {
-			os.MkdirAll(path, f.Mode())
-		} else {
-			var dir string
-			if lastIndex := strings.LastIndex(path, string(os.PathSeparator)); lastIndex > -1 {
-				dir = path[:lastIndex]
-			}
-
-			err = os.MkdirAll(dir, f.Mode())
-			if err != nil {
-				log.Fatal(err)
-				return "", err
-			}
-			f, err := os.OpenFile(
-				path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-			if err != nil {
-				return "", err
-			}
-			defer f.Close()
-
-			_, err = io.Copy(f, rc)
+			err = os.MkdirAll(path, os.ModePerm)
 			if err != nil {
 				return "", err
 			}
+			continue
+		}
+		written, err := extractZipFile(f, path, limits.MaxTotalSize-total)
+		if err != nil {
+			return "", err
+		}
+		total += written
+		if total > limits.MaxTotalSize {
+			return "", &UnsafeZipEntryError{Zip: src, Entry: f.Name, Reason: fmt.Sprintf("total uncompressed size exceeds %d bytes", limits.MaxTotalSize)}
+		}
+		if written != f.UncompressedSize64 {
+			return "", &UnsafeZipEntryError{Zip: src, Entry: f.Name, Reason: "size does not match the zip header"}
 		}
 	}
 	return path, nil
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// ModuleStatus holds the retractions and the deprecation the author of a module declared
+// in the go.mod of its latest version
+type ModuleStatus struct {
+	Retract    []*modfile.Retract
+	Deprecated string
+}
+
+// getModuleStatus reads the go.mod of the latest of versions, which must be every known version of the module.
+// Like the go command, retracted versions count, so a version can retract itself.
+func getModuleStatus(modulePath string, versions []string) (status ModuleStatus, err error) {
+	latest := latestVersion(versions)
+	if latest == "" {
+		return
+	}
+	f, err := getModuleGoMod(modulePath, latest)
+	if err != nil {
+		return
+	}
+	status.Retract = f.Retract
+	if f.Module != nil {
+		status.Deprecated = f.Module.Deprecated
+	}
+	return
+}
+
+// retracted returns the rationale of the retraction if v is retracted
+func (s ModuleStatus) retracted(v string) (rationale string, ok bool) {
+	for _, r := range s.Retract {
+		if semver.Compare(r.Low, v) <= 0 && semver.Compare(v, r.High) <= 0 {
+			if r.Rationale == "" {
+				return "retracted by module author", true
+			}
+			return r.Rationale, true
+		}
+	}
+	return "", false
+}
+
+// withoutRetracted returns the versions that are not retracted
+func (s ModuleStatus) withoutRetracted(versions []string) []string {
+	var ret []string
+	for _, v := range versions {
+		if _, ok := s.retracted(v); !ok {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// getModuleVersionsStatus returns the versions of the module that are not retracted, and its status
+func getModuleVersionsStatus(modulePath string) ([]string, ModuleStatus, error) {
+	versions, err := getModuleVersions(modulePath)
+	if err != nil {
+		return nil, ModuleStatus{}, err
+	}
+	status, err := getModuleStatus(modulePath, versions)
+	if err != nil {
+		return nil, ModuleStatus{}, err
+	}
+	return status.withoutRetracted(versions), status, nil
+}
+
+// warnModuleStatus logs a warning with the rationale if the module version is retracted or the module
+// is deprecated. A failed lookup is only logged, it never stops an install.
+func warnModuleStatus(m module.Version) {
+	_, status, err := getModuleVersionsStatus(m.Path)
+	if err != nil {
+		log.Printf("could not check %s for retractions: %v", m, err)
+		return
+	}
+	if rationale, ok := status.retracted(m.Version); ok {
+		log.Printf("warning: %s is retracted: %s", m, rationale)
+	}
+	if status.Deprecated != "" {
+		log.Printf("warning: %s is deprecated: %s", m.Path, status.Deprecated)
+	}
+}
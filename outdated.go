@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+)
+
+type OutdatedPlugin struct {
+	Name    string `json:"name"`
+	Current string `json:"current"`
+	Wanted  string `json:"wanted"` // highest version with the same major version
+	Latest  string `json:"latest"`
+	// Retracted is the rationale if the current version has been retracted upstream
+	Retracted  string `json:"retracted,omitempty"`
+	Deprecated string `json:"deprecated,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// checkOutdated queries the remote versions of every plugin concurrently and returns the plugins
+// that have a newer version, were retracted or deprecated, and those that could not be checked.
+func checkOutdated(plugins PluginInfos) []OutdatedPlugin {
+	results := make([]OutdatedPlugin, len(plugins))
+	var wg sync.WaitGroup
+	for k, p := range plugins {
+		wg.Add(1)
+		go func(k int, p PluginInfo) {
+			defer wg.Done()
+			current := p.Version.Original()
+			results[k] = OutdatedPlugin{Name: p.Name, Current: current, Wanted: current, Latest: current}
+			versions, status, err := getModuleVersionsStatus(p.Name)
+			if err != nil {
+				results[k].Error = err.Error()
+				return
+			}
+			if rationale, ok := status.retracted(current); ok {
+				results[k].Retracted = rationale
+			}
+			results[k].Deprecated = status.Deprecated
+			if v := selectUpgrade(current, versions, UpgradeMinor); v != "" {
+				results[k].Wanted = v
+			}
+			if v := selectUpgrade(current, versions, UpgradeMajor); v != "" {
+				results[k].Latest = v
+			}
+		}(k, p)
+	}
+	wg.Wait()
+
+	var outdated []OutdatedPlugin
+	for _, r := range results {
+		if r.Error != "" || r.Wanted != r.Current || r.Latest != r.Current || r.Retracted != "" || r.Deprecated != "" {
+			outdated = append(outdated, r)
+		}
+	}
+	return outdated
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/mod/module"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	OutputTable = "table"
+	OutputJson  = "json"
+	OutputYaml  = "yaml"
+)
+
+// outputFormat is set by the global --output flag
+var outputFormat = OutputTable
+
+// Exit codes returned by the process, so automation can tell failures apart
+const (
+	ExitOK         = 0
+	ExitError      = 1 // any error not listed below
+	ExitUsage      = 2 // invalid flags or arguments
+	ExitNotFound   = 3 // module, version or plugin does not exist
+	ExitNetwork    = 4 // a source could not be reached
+	ExitChecksum   = 5 // a download failed verification
+	ExitScript     = 6 // an Install or Uninstall script failed
+	ExitPermission = 7 // the permissions requested by a plugin were not approved
+	ExitLocked     = 8 // another PluginManager process is using PluginManagerRoot
+)
+
+// UsageError is returned for invalid flags or arguments
+type UsageError struct {
+	Message string
+}
+
+func (e *UsageError) Error() string {
+	return e.Message
+}
+
+type RequireRecord struct {
+	Path     string `json:"path" yaml:"path"`
+	Version  string `json:"version" yaml:"version"`
+	Indirect bool   `json:"indirect" yaml:"indirect"`
+}
+
+type PluginRecord struct {
+	Name        string          `json:"name" yaml:"name"`
+	Version     string          `json:"version" yaml:"version"`
+	Path        string          `json:"path" yaml:"path"`
+	Author      string          `json:"author" yaml:"author"`
+	Description string          `json:"description" yaml:"description"`
+	License     string          `json:"license" yaml:"license"`
+	Enabled     bool            `json:"enabled" yaml:"enabled"`
+	Require     []RequireRecord `json:"require" yaml:"require"`
+}
+
+type VersionRecord struct {
+	Version string    `json:"version" yaml:"version"`
+	Time    time.Time `json:"time" yaml:"time"`
+	// Retracted is the rationale if the version is retracted
+	Retracted string `json:"retracted,omitempty" yaml:"retracted,omitempty"`
+	Error     string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+type ErrorRecord struct {
+	Error string `json:"error" yaml:"error"`
+	Code  int    `json:"code" yaml:"code"`
+}
+
+func newPluginRecord(p PluginInfo) PluginRecord {
+	r := PluginRecord{
+		Name:    p.Name,
+		Version: p.Version.Original(),
+		Path:    p.Path,
+		Enabled: !isPluginDisabled(p.Name),
+		Require: []RequireRecord{},
+	}
+	if p.Manifest != nil {
+		r.Author = p.Manifest.Author
+		r.Description = p.Manifest.Description
+		r.License = p.Manifest.License
+	}
+	if p.ModuleInfo != nil {
+		for _, v := range p.ModuleInfo.Require {
+			r.Require = append(r.Require, RequireRecord{Path: v.Mod.Path, Version: v.Mod.Version, Indirect: v.Indirect})
+		}
+	}
+	return r
+}
+
+func newPluginRecords(plugins PluginInfos) []PluginRecord {
+	records := []PluginRecord{}
+	for _, p := range plugins {
+		records = append(records, newPluginRecord(p))
+	}
+	return records
+}
+
+func newVersionRecords(versions []ModuleVersionInfo, status ModuleStatus) []VersionRecord {
+	records := []VersionRecord{}
+	for _, v := range versions {
+		r := VersionRecord{Version: v.Version, Time: v.Time}
+		r.Retracted, _ = status.retracted(v.Version)
+		if v.Err != nil {
+			r.Error = v.Err.Error()
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func setOutputFormat(format string) error {
+	switch format {
+	case OutputTable, OutputJson, OutputYaml:
+		outputFormat = format
+		return nil
+	}
+	return &UsageError{Message: fmt.Sprintf("unknown output format %q, use json, yaml or table", format)}
+}
+
+// machineOutput reports whether stdout is reserved for json or yaml records
+func machineOutput() bool {
+	return outputFormat != OutputTable
+}
+
+// onUsageError reports invalid flags as a UsageError. The help goes to stderr in machine output mode,
+// so stdout only holds the error record.
+func onUsageError(c *cli.Context, err error, isSubcommand bool) error {
+	if c.Command.Name == "" && !isSubcommand {
+		// the global flags failed to parse, so Before did not apply --output
+		_ = setOutputFormat(c.String("output"))
+	}
+	if machineOutput() {
+		out := c.App.Writer
+		c.App.Writer = c.App.ErrWriter
+		defer func() { c.App.Writer = out }()
+	}
+	fmt.Fprintf(c.App.Writer, "Incorrect Usage: %v\n\n", err)
+	switch {
+	case isSubcommand:
+		_ = cli.ShowSubcommandHelp(c)
+	case c.Command.Name != "":
+		_ = cli.ShowCommandHelp(c, c.Command.Name)
+	default:
+		_ = cli.ShowAppHelp(c)
+	}
+	return &UsageError{Message: err.Error()}
+}
+
+// setUsageErrorHandlers sets onUsageError on the commands and their subcommands
+func setUsageErrorHandlers(commands []*cli.Command) {
+	for _, c := range commands {
+		c.OnUsageError = onUsageError
+		setUsageErrorHandlers(c.Subcommands)
+	}
+}
+
+// printRecords writes v to stdout in the selected output format, table output is done by printTable instead
+func printRecords(v interface{}, printTable func()) error {
+	switch outputFormat {
+	case OutputJson:
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	case OutputYaml:
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	printTable()
+	return nil
+}
+
+// exitCode maps err to the exit code of the process
+func exitCode(err error) int {
+	var usageErr *UsageError
+	var checksumErr *ChecksumMismatchError
+	var securityErr *SumDBSecurityError
+	var scriptErr *ScriptError
+	var pluginErr *PluginNotFoundError
+	var permissionErr *PermissionError
+	var lockedErr *RootLockedError
+	var serverErr *ServerNotFoundError
+	var pathErr *module.InvalidPathError
+	var versionErr *module.InvalidVersionError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &usageErr), errors.As(err, &pathErr), errors.As(err, &versionErr), errors.As(err, &serverErr):
+		return ExitUsage
+	case errors.As(err, &permissionErr):
+		return ExitPermission
+	case errors.As(err, &lockedErr):
+		return ExitLocked
+	case errors.As(err, &checksumErr), errors.As(err, &securityErr):
+		return ExitChecksum
+	case errors.As(err, &scriptErr):
+		return ExitScript
+	case isNotFound(err), errors.As(err, &pluginErr):
+		return ExitNotFound
+	case isNetworkError(err):
+		return ExitNetwork
+	}
+	var statusErr *HttpStatusError
+	if errors.As(err, &statusErr) {
+		return ExitNetwork
+	}
+	return ExitError
+}
+
+// printError prints err as an ErrorRecord in machine output mode, or logs it otherwise
+func printError(err error) {
+	code := exitCode(err)
+	_ = printRecords(ErrorRecord{Error: err.Error(), Code: code}, func() {
+		log.Println(err)
+	})
+}
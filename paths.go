@@ -1,6 +1,115 @@
 package main
 
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
 const (
 	DefaultDownloadSource = "https://goproxy.cn"
-	PluginManagerRoot     = "plugins/PluginManager"
+	// DefaultPluginManagerDir is PluginManagerRoot relative to the server directory
+	DefaultPluginManagerDir = "plugins/PluginManager"
+	// RootEnv names the environment variable that sets PluginManagerRoot if --root is not given
+	RootEnv = "PLUGINMANAGER_ROOT"
 )
+
+// PluginManagerRoot holds the state files, pkg and cache, it is set by resolveRoot before a command runs
+var PluginManagerRoot string
+
+// ServerDir is the BDS directory PluginManagerRoot belongs to, it is set by resolveRoot too
+var ServerDir string
+
+// serverExecutables are the names of the BDS executable, the LiteLoader loader replaces it on Windows
+var serverExecutables = []string{"bedrock_server", "bedrock_server.exe", "bedrock_server_mod.exe"}
+
+// liteLoaderFiles are present in a server directory with LiteLoader installed
+var liteLoaderFiles = []string{"LiteLoader.dll", "bedrock_server_mod.exe", "plugins/LiteLoader"}
+
+// ServerNotFoundError is returned when no server directory was found in the working directory,
+// or the given root, or their parents
+type ServerNotFoundError struct {
+	Dir string
+	// Server is a directory with bedrock_server but without LiteLoader, if one was found
+	Server string
+	// Root is set if Dir was given by --root or RootEnv
+	Root bool
+}
+
+func (e *ServerNotFoundError) Error() string {
+	if e.Server != "" {
+		return fmt.Sprintf("LiteLoader is not installed in the server directory %s, install it or use --root or %s", e.Server, RootEnv)
+	}
+	if e.Root {
+		return fmt.Sprintf("no server directory with bedrock_server and LiteLoader in %s or its parents, the root must be in the server directory", e.Dir)
+	}
+	return fmt.Sprintf("no server directory with bedrock_server and LiteLoader in %s or its parents, run PluginManager in the server directory or use --root or %s", e.Dir, RootEnv)
+}
+
+// resolveRoot returns the server directory and PluginManagerRoot. The root is root if given by --root
+// or RootEnv, else plugins/PluginManager of the server directory. The server directory is found by
+// walking up from the root if it was given, else from the working directory.
+func resolveRoot(root string) (server string, managerRoot string, err error) {
+	if root == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", "", err
+		}
+		server, err = findServerDir(wd)
+		if err != nil {
+			return "", "", err
+		}
+		return server, filepath.Join(server, filepath.FromSlash(DefaultPluginManagerDir)), nil
+	}
+
+	managerRoot, err = filepath.Abs(root)
+	if err != nil {
+		return "", "", err
+	}
+	server, err = findServerDir(managerRoot)
+	if notFound, ok := err.(*ServerNotFoundError); ok {
+		notFound.Root = true
+	}
+	if err != nil {
+		return "", "", err
+	}
+	// plugins are deployed into the plugins directory, which must stay outside of the root
+	if plugins := filepath.Join(server, "plugins"); isWithin(plugins, managerRoot) {
+		return "", "", &UsageError{Message: fmt.Sprintf("root %s must not contain the plugins directory %s of the server", managerRoot, plugins)}
+	}
+	return server, managerRoot, nil
+}
+
+// findServerDir returns dir or the closest of its parents that has bedrock_server and LiteLoader
+func findServerDir(dir string) (string, error) {
+	notFound := &ServerNotFoundError{Dir: dir}
+	for {
+		if anyExists(dir, serverExecutables) {
+			if anyExists(dir, liteLoaderFiles) {
+				return dir, nil
+			}
+			if notFound.Server == "" {
+				notFound.Server = dir
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", notFound
+		}
+		dir = parent
+	}
+}
+
+func anyExists(dir string, names []string) bool {
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// serverDir is the BDS directory, PluginManagerRoot is inside of it
+func serverDir() string {
+	return ServerDir
+}
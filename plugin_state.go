@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+)
+
+// isPluginDisabled reports whether the plugin was turned off with the disable command
+func isPluginDisabled(name string) bool {
+	return GlobalConfig.Disabled[name]
+}
+
+// setPluginEnabled deploys and runs the Enable script, or runs the Disable script and removes the deployed
+// files, of every installed version of the plugin and records the state in PluginManager.json.
+// The packages stay in pkg and the plugin stays installed, so Install and Uninstall don't run.
+func setPluginEnabled(t *Transaction, name string, enabled bool) (PluginInfos, error) {
+	packages, err := getLocalPackages()
+	if err != nil {
+		return nil, err
+	}
+	var matched PluginInfos
+	for _, p := range packages {
+		if p.Name == name {
+			matched = append(matched, p)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, &PluginNotFoundError{Name: name}
+	}
+	if isPluginDisabled(name) != enabled {
+		log.Printf("%s is already %s", name, pluginState(name))
+		return matched, nil
+	}
+
+	if GlobalConfig.Disabled == nil {
+		GlobalConfig.Disabled = map[string]bool{}
+	}
+	for _, p := range matched {
+		if enabled {
+			// deployPlugin skips disabled plugins
+			delete(GlobalConfig.Disabled, name)
+			err = deployPlugin(t, p)
+			if err == nil {
+				err = runStateScript(p, p.Manifest.Enable, "enable")
+			}
+		} else {
+			err = runStateScript(p, p.Manifest.Disable, "disable")
+			if err == nil {
+				p := p
+				t.onRollback(func() error {
+					return runStateScript(p, p.Manifest.Enable, "enable")
+				})
+				err = undeployPlugin(t, p)
+			}
+			GlobalConfig.Disabled[name] = true
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("%s is %s", name, pluginState(name))
+	return matched, saveConfig()
+}
+
+// runStateScript runs script if the manifest declares it
+func runStateScript(p PluginInfo, script, scriptName string) error {
+	err := runPluginScript(p, script)
+	if err != nil {
+		return &ScriptError{Plugin: p.Name, Script: scriptName, Err: err}
+	}
+	return nil
+}
+
+// forgetPluginState drops the recorded state of a plugin that is no longer installed
+func forgetPluginState(name string) error {
+	if !isPluginDisabled(name) {
+		return nil
+	}
+	delete(GlobalConfig.Disabled, name)
+	return saveConfig()
+}
+
+func pluginState(name string) string {
+	if isPluginDisabled(name) {
+		return "disabled"
+	}
+	return "enabled"
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/hashicorp/go-version"
 	"golang.org/x/mod/modfile"
-	"io"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type PluginManifest struct {
@@ -19,6 +23,15 @@ type PluginManifest struct {
 
 	Install   string
 	Uninstall string
+	// Enable and Disable are run by the enable and disable commands if they are declared
+	Enable  string
+	Disable string
+
+	// Deploy lists the files placed into plugins/ for LiteLoader to load
+	Deploy []DeployEntry
+
+	// Permissions the Install and Uninstall scripts need, approved by the user on install
+	Permissions PluginPermissions
 }
 
 type PluginInfo struct {
@@ -33,41 +46,55 @@ type PluginInfo struct {
 type PluginInfos []PluginInfo
 
 func getPluginInfo(path string) (Plugin PluginInfo, err error) {
-	_, mainName := filepath.Split(path)
+	return readPluginInfo(filepath.Join(PluginManagerRoot, "pkg"), path)
+}
+
+// readPluginInfo reads the package at path, the module path is taken from its directory relative to root
+func readPluginInfo(root, path string) (Plugin PluginInfo, err error) {
+	_, mainName := filepath.Split(filepath.Clean(path))
 	index := strings.LastIndex(mainName, "@")
 	if index == -1 {
 		err = fmt.Errorf("invalid plugin name: %s", mainName)
 		return
 	}
-	rel, err := filepath.Rel(filepath.Join(PluginManagerRoot, "pkg"), path)
+	rel, err := filepath.Rel(root, path)
 	if err != nil {
 		return
 	}
 	rel, _ = filepath.Split(rel)
-	Plugin.Name = filepath.Join(rel, mainName[:index])
-	ver, err := version.NewVersion(mainName[index+1:])
+	name := filepath.ToSlash(filepath.Join(rel, mainName[:index]))
+	Plugin.Name, err = unescapeModuleUrl(name)
+	if err != nil && module.CheckPath(name) == nil {
+		// installed before package directories were escaped
+		Plugin.Name, err = name, nil
+	}
+	if err != nil {
+		return
+	}
+	versionStr, err := unescapeModuleVersion(mainName[index+1:])
+	if err != nil {
+		return
+	}
+	ver, err := version.NewVersion(versionStr)
 	if err != nil {
 		return
 	}
 	Plugin.Version = ver
 	Plugin.Path = path
 
-	manifestFileReader, err := os.Open(filepath.Join(path, "manifest.json"))
+	// read the files at once, an open file can't be moved on Windows
+	manifestData, err := os.ReadFile(filepath.Join(path, "manifest.json"))
 	if err != nil {
 		return
 	}
 	var manifest PluginManifest
-	err = json.NewDecoder(manifestFileReader).Decode(&manifest)
+	err = json.Unmarshal(manifestData, &manifest)
 	if err != nil {
 		return
 	}
 
 	Plugin.Manifest = &manifest
-	modFileReader, err := os.Open(filepath.Join(path, "go.mod"))
-	if err != nil {
-		return
-	}
-	modFileData, err := io.ReadAll(modFileReader)
+	modFileData, err := os.ReadFile(filepath.Join(path, "go.mod"))
 	if err != nil {
 		return
 	}
@@ -119,10 +146,313 @@ func getLocalPackages() (PluginInfos, error) {
 	return plugins, err
 }
 
+// ScriptError is returned when the Install or Uninstall script of a plugin fails
+type ScriptError struct {
+	Plugin string
+	Script string // "install" or "uninstall"
+	Err    error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("%s script of %s failed: %v", e.Script, e.Plugin, e.Err)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+type PluginNotFoundError struct {
+	Name string
+}
+
+func (e *PluginNotFoundError) Error() string {
+	return fmt.Sprintf("plugin %s is not installed", e.Name)
+}
+
+// runPluginScript runs a script shipped with the plugin in a sandbox limited to the approved permissions,
+// script is relative to the plugin path. The script can read the plugin's Name, Version and Path
+// through the global `plugin` object.
+func runPluginScript(p PluginInfo, script string) error {
+	if script == "" {
+		return nil
+	}
+	permissions, err := approvePermissions(p)
+	if err != nil {
+		return err
+	}
+	sandbox, err := newPluginSandbox(p, permissions)
+	if err != nil {
+		return err
+	}
+	vm := newVmInstance(sandbox)
+	err = vm.Set("plugin", map[string]interface{}{
+		"Name":    p.Name,
+		"Version": p.Version.Original(),
+		"Path":    p.Path,
+	})
+	if err != nil {
+		return err
+	}
+	return runScriptFile(vm, filepath.Join(p.Path, script))
+}
+
+// installPlugin runs the Install script declared in the manifest of the plugin at path
 func installPlugin(path string) error {
+	p, err := getPluginInfo(path)
+	if err != nil {
+		return err
+	}
+	err = runPluginScript(p, p.Manifest.Install)
+	if err != nil {
+		return &ScriptError{Plugin: p.Name, Script: "install", Err: err}
+	}
 	return nil
 }
 
+// uninstallPlugin runs the Uninstall script declared in the manifest of the plugin at path
 func uninstallPlugin(path string) error {
+	p, err := getPluginInfo(path)
+	if err != nil {
+		return err
+	}
+	err = runPluginScript(p, p.Manifest.Uninstall)
+	if err != nil {
+		return &ScriptError{Plugin: p.Name, Script: "uninstall", Err: err}
+	}
+	return nil
+}
+
+// downloadModuleVersion returns the zip of the specified module version and its h1: hash, from the cache
+// if it is there, or downloads it into the cache. A download is verified with verifyModuleZip,
+// a zip that fails verification is quarantined.
+func downloadModuleVersion(modulePath, versionStr, expectedHash string) (fileName string, hash string, err error) {
+	m := module.Version{Path: modulePath, Version: versionStr}
+	if fileName, hash, ok := cachedModuleZip(modulePath, versionStr); ok {
+		if expectedHash != "" && hash != expectedHash {
+			return "", "", &ChecksumMismatchError{Module: m, File: "zip", Downloaded: hash, Expected: expectedHash, Source: "locked"}
+		}
+		log.Printf("using cached %s", m)
+		return fileName, hash, nil
+	}
+
+	fileName, hash, err = fillModuleZip(m, expectedHash)
+	if err != nil {
+		return
+	}
+
+	if maxSize := GlobalConfig.Cache.MaxSize; maxSize > 0 {
+		touchCacheEntry(modulePath, versionStr)
+		// the zip is unpacked after this returns
+		evicted, evictErr := evictCache(maxSize, m)
+		if evictErr != nil {
+			log.Println(evictErr)
+		}
+		for _, e := range evicted {
+			log.Printf("evicted %s from cache", e)
+		}
+	}
+	return
+}
+
+// fillModuleZip downloads the zip of the module version into the cache under its cache lock. Another
+// process may have filled the cache while this one waited for the lock, then its zip is used.
+func fillModuleZip(m module.Version, expectedHash string) (fileName string, hash string, err error) {
+	fileName, err = cacheFile(m.Path, m.Version, ".zip")
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(fileName), os.ModePerm)
+	if err != nil {
+		return
+	}
+	unlock, err := lockCacheFile(fileName)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	if cached, cachedHash, ok := cachedModuleZip(m.Path, m.Version); ok {
+		if expectedHash != "" && cachedHash != expectedHash {
+			return "", "", &ChecksumMismatchError{Module: m, File: "zip", Downloaded: cachedHash, Expected: expectedHash, Source: "locked"}
+		}
+		return cached, cachedHash, nil
+	}
+
+	log.Printf("downloading %s", m)
+	err = downloadModuleZip(m.Path, m.Version, fileName)
+	if err != nil {
+		return
+	}
+	hash, err = dirhash.HashZip(fileName, dirhash.Hash1)
+	if err != nil {
+		return
+	}
+	err = verifyModuleZip(m, fileName, hash, expectedHash)
+	if _, ok := err.(*ChecksumMismatchError); ok {
+		if qErr := quarantineCacheFile(fileName); qErr != nil {
+			log.Println(qErr)
+		}
+	}
+	if err != nil {
+		return
+	}
+	err = writeCacheFile(m.Path, m.Version, ".ziphash", []byte(hash+"\n"))
+	if err != nil {
+		return
+	}
+	// make sure the version is listed in the cache, so it can be installed offline
+	_, err = getModuleVersionInfo(m.Path, m.Version)
+	return
+}
+
+// installModuleZip unpacks a downloaded module zip into the staging directory of the transaction,
+// validates the manifest and go.mod, moves the package into pkg, deploys its files and runs its Install script
+func installModuleZip(t *Transaction, fileName string, m module.Version) (p PluginInfo, err error) {
+	staging := t.tempPath("pkg")
+	path, err := UnzipModule(fileName, staging, m)
+	if err != nil {
+		return
+	}
+	p, err = readPluginInfo(staging, filepath.Join(staging, path))
+	if err != nil {
+		return p, fmt.Errorf("%s: invalid package: %w", m, err)
+	}
+	if p.Name != m.Path || p.Version.Original() != m.Version {
+		return p, fmt.Errorf("%s: package is %s@%s", m, p.Name, p.Version.Original())
+	}
+	if p.ModuleInfo.Module == nil || p.ModuleInfo.Module.Mod.Path != m.Path {
+		return p, fmt.Errorf("%s: go.mod does not declare module %s", m, m.Path)
+	}
+
+	pluginPath := filepath.Join(PluginManagerRoot, "pkg", path)
+	err = t.move(filepath.Join(staging, path), pluginPath)
+	if err != nil {
+		return
+	}
+	p.Path = pluginPath
+	err = deployPlugin(t, p)
+	if err != nil {
+		return
+	}
+	err = installPlugin(pluginPath)
+	if err != nil {
+		return
+	}
+	t.onRollback(func() error {
+		return uninstallPlugin(pluginPath)
+	})
+	return
+}
+
+// installModuleVersion downloads and installs the specified module version.
+// If expectedHash is not empty, the download must match it or nothing is installed.
+func installModuleVersion(t *Transaction, modulePath, versionStr, expectedHash string) (p PluginInfo, hash string, err error) {
+	fileName, hash, err := downloadModuleVersion(modulePath, versionStr, expectedHash)
+	if err != nil {
+		return
+	}
+	p, err = installModuleZip(t, fileName, module.Version{Path: modulePath, Version: versionStr})
+	return
+}
+
+// removePlugin runs the Uninstall script of the plugin, deletes its deployed files and its package directory
+func removePlugin(t *Transaction, p PluginInfo) error {
+	log.Printf("Removing %s[%s]\n", p.Name, p.Version)
+	err := uninstallPlugin(p.Path)
+	if err != nil {
+		return err
+	}
+	t.onRollback(func() error {
+		return installPlugin(p.Path)
+	})
+	err = undeployPlugin(t, p)
+	if err != nil {
+		return err
+	}
+	return t.remove(p.Path)
+}
+
+// removePlugins removes the plugins in order, drops them from the lock file and forgets
+// the enabled state of the plugins that have no installed version left
+func removePlugins(t *Transaction, local, removed PluginInfos) error {
+	lock, err := loadLockFile()
+	if err != nil {
+		return err
+	}
+	for _, p := range removed {
+		err = removePlugin(t, p)
+		if err != nil {
+			return err
+		}
+		lock.Remove(p.Name, p.Version.Original())
+	}
+	err = lock.Save()
+	if err != nil {
+		return err
+	}
+	remaining := local.without(removed)
+	for _, p := range removed {
+		if remaining.newest(p.Name) == nil {
+			err = forgetPluginState(p.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return removeEmptyFolders(filepath.Join(PluginManagerRoot, "pkg"))
+}
+
+// installBuildList installs every module of the build list that is not installed yet, in order,
+// and records them in the lock file. direct is the module path the user asked for.
+func installBuildList(t *Transaction, buildList []module.Version, direct string) (installed PluginInfos, err error) {
+	local, err := getLocalPackages()
+	if err != nil {
+		return
+	}
+	lock, err := loadLockFile()
+	if err != nil {
+		return
+	}
+	for _, m := range buildList {
+		if local.find(m.Path, m.Version) != nil {
+			log.Printf("%s is already installed", m)
+			if locked := lock.Find(m.Path, m.Version); locked != nil && m.Path == direct {
+				locked.Direct = true
+			}
+			continue
+		}
+		warnModuleStatus(m)
+		var p PluginInfo
+		var hash string
+		p, hash, err = installModuleVersion(t, m.Path, m.Version, "")
+		var notPlugin *NotPluginError
+		if errors.As(err, &notPlugin) && m.Path != direct {
+			// a Go library the plugin requires, there is nothing to install
+			log.Printf("skipping %s: not a plugin", m)
+			err = nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		installed = append(installed, p)
+		lock.Add(LockedModule{
+			Path:        m.Path,
+			Version:     m.Version,
+			Hash:        hash,
+			InstallTime: time.Now(),
+			Direct:      m.Path == direct,
+		})
+	}
+	err = lock.Save()
+	return
+}
+
+// find returns the installed plugin with the specified module path and version, or nil if there is none
+func (w PluginInfos) find(modulePath, versionStr string) *PluginInfo {
+	for k, p := range w {
+		if p.Name == modulePath && p.Version.Original() == versionStr {
+			return &w[k]
+		}
+	}
 	return nil
 }
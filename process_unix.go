@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// processAlive reports whether a process with the pid runs, signal 0 only checks for it
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
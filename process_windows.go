@@ -0,0 +1,26 @@
+//go:build windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// stillActive is STILL_ACTIVE, the exit code GetExitCodeProcess reports for a running process
+const stillActive = 259
+
+// processAlive reports whether a process with the pid runs. A process that exited can still be
+// opened while handles to it exist, so its exit code is checked too.
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// access denied means it exists
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if syscall.GetExitCodeProcess(h, &code) != nil {
+		return true
+	}
+	return code == stillActive
+}
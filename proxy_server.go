@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// newProxyHandler serves the download cache over the GOPROXY protocol.
+// Paths are escaped like escapeModuleUrl, so they map directly onto the cache layout.
+// Requests that miss the cache are fetched from the configured sources and stored,
+// unless PluginManager is offline, which serve is without --upstream.
+func newProxyHandler() http.Handler {
+	fills := &fillLocks{locks: map[string]*fillLock{}}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/")
+		var escapedPath, file string
+		if i := strings.Index(path, "/@v/"); i >= 0 {
+			escapedPath, file = path[:i], path[i+len("/@v/"):]
+		} else if strings.HasSuffix(path, "/@latest") {
+			escapedPath, file = strings.TrimSuffix(path, "/@latest"), "@latest"
+		} else {
+			http.NotFound(w, r)
+			return
+		}
+		modulePath, err := unescapeModuleUrl(escapedPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		switch file {
+		case "list":
+			versions, err := getModuleVersions(modulePath)
+			if err != nil {
+				serveProxyError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			for _, v := range versions {
+				w.Write([]byte(v + "\n"))
+			}
+			return
+		case "@latest":
+			// may cache the info of the latest version
+			defer fills.lock(modulePath)()
+			info, err := getModuleVersionLatest(modulePath)
+			if err != nil {
+				serveProxyError(w, err)
+				return
+			}
+			serveProxyJson(w, info)
+			return
+		}
+
+		ext := filepath.Ext(file)
+		versionStr, err := unescapeModuleVersion(strings.TrimSuffix(file, ext))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		// cache hits are served as they are, only a miss waits for the fill of the same version
+		if ext == ".info" || ext == ".mod" || ext == ".zip" {
+			if fileName, ok := cachedProxyFile(modulePath, versionStr, ext); ok {
+				serveProxyFile(w, r, fileName, ext)
+				return
+			}
+			defer fills.lock(modulePath + "@" + versionStr)()
+		}
+		switch ext {
+		case ".info":
+			info, err := getModuleVersionInfo(modulePath, versionStr)
+			if err != nil {
+				serveProxyError(w, err)
+				return
+			}
+			serveProxyJson(w, info)
+		case ".mod":
+			_, err := getModuleGoMod(modulePath, versionStr)
+			if err != nil {
+				serveProxyError(w, err)
+				return
+			}
+			fileName, err := cacheFile(modulePath, versionStr, ".mod")
+			if err != nil {
+				serveProxyError(w, err)
+				return
+			}
+			serveProxyFile(w, r, fileName, ext)
+		case ".zip":
+			fileName, _, err := downloadModuleVersion(modulePath, versionStr, "")
+			if err != nil {
+				serveProxyError(w, err)
+				return
+			}
+			serveProxyFile(w, r, fileName, ext)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// fillLocks serializes the cache fills of one key, so concurrent requests for a missing
+// module version fetch it once while requests for anything else don't wait
+type fillLocks struct {
+	mu    sync.Mutex
+	locks map[string]*fillLock
+}
+
+type fillLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks key and returns the function that unlocks it
+func (f *fillLocks) lock(key string) func() {
+	f.mu.Lock()
+	l := f.locks[key]
+	if l == nil {
+		l = &fillLock{}
+		f.locks[key] = l
+	}
+	l.users++
+	f.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		f.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(f.locks, key)
+		}
+		f.mu.Unlock()
+	}
+}
+
+// cachedProxyFile returns the cached file if it is complete. A zip is complete once its hash is
+// recorded, which downloadModuleVersion does after verifying it.
+func cachedProxyFile(modulePath, versionStr, ext string) (string, bool) {
+	fileName, err := cacheFile(modulePath, versionStr, ext)
+	if err != nil {
+		return "", false
+	}
+	if _, err = os.Stat(fileName); err != nil {
+		return "", false
+	}
+	if ext == ".zip" {
+		if _, err = readCacheFile(modulePath, versionStr, ".ziphash"); err != nil {
+			return "", false
+		}
+	}
+	return fileName, true
+}
+
+func serveProxyFile(w http.ResponseWriter, r *http.Request, fileName, ext string) {
+	switch ext {
+	case ".info":
+		w.Header().Set("Content-Type", "application/json")
+	case ".zip":
+		w.Header().Set("Content-Type", "application/zip")
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	}
+	http.ServeFile(w, r, fileName)
+}
+
+func serveProxyJson(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		serveProxyError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func serveProxyError(w http.ResponseWriter, err error) {
+	if isNotFound(err) || errors.Is(err, errSourceOff) || errors.Is(err, errSourceDirect) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Println(err)
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// logRequests logs every request the proxy serves
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+		h.ServeHTTP(w, r)
+	})
+}
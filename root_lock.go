@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LockMode is how a command locks PluginManagerRoot against other PluginManager processes
+type LockMode int
+
+const (
+	// LockNone is for commands that don't touch the installed plugins
+	LockNone LockMode = iota
+	// LockShared is for commands that only read, any number of them can run at the same time
+	LockShared
+	// LockExclusive is for commands that change pkg, cache or the state files
+	LockExclusive
+)
+
+const lockPollInterval = 500 * time.Millisecond
+
+// LockOwner is the content of a lock file
+type LockOwner struct {
+	PID     int       `json:"pid"`
+	Command string    `json:"command"`
+	Since   time.Time `json:"since"`
+}
+
+func (o LockOwner) String() string {
+	return fmt.Sprintf("process %d (%s) since %s", o.PID, o.Command, o.Since.Format(time.RFC3339))
+}
+
+// RootLockedError is returned with --no-wait when another process holds a conflicting lock
+type RootLockedError struct {
+	Owner LockOwner
+}
+
+func (e *RootLockedError) Error() string {
+	return fmt.Sprintf("%s is in use by %s, try again later or use --wait", PluginManagerRoot, e.Owner)
+}
+
+// RootLock is a lock held by this process, the locks are advisory and only PluginManager honors them
+type RootLock struct {
+	path string
+}
+
+// locksDir holds the file of the exclusive lock and one file per shared lock
+func locksDir() string {
+	return filepath.Join(PluginManagerRoot, "locks")
+}
+
+func exclusiveLockPath() string {
+	return filepath.Join(locksDir(), "exclusive")
+}
+
+func sharedLockPath(pid int) string {
+	return filepath.Join(locksDir(), "shared-"+strconv.Itoa(pid))
+}
+
+// lockRoot takes the lock, waiting until conflicting locks are released if wait is set.
+// Locks of processes that no longer run are stale and removed.
+func lockRoot(mode LockMode, wait bool, command string) (*RootLock, error) {
+	if mode == LockNone {
+		return nil, nil
+	}
+	err := os.MkdirAll(locksDir(), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	own := LockOwner{PID: os.Getpid(), Command: command, Since: time.Now()}
+	for waited := false; ; waited = true {
+		var lock *RootLock
+		var owner *LockOwner
+		if mode == LockExclusive {
+			lock, owner, err = tryLockExclusive(own)
+		} else {
+			lock, owner, err = tryLockShared(own)
+		}
+		if err != nil || lock != nil {
+			return lock, err
+		}
+		if !wait {
+			return nil, &RootLockedError{Owner: *owner}
+		}
+		if !waited {
+			log.Printf("waiting for %s", owner)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// tryLockExclusive creates the exclusive lock file and then checks for readers, a reader does it the
+// other way round, so at least one of them sees the other. New readers wait while a writer waits.
+func tryLockExclusive(own LockOwner) (*RootLock, *LockOwner, error) {
+	path := exclusiveLockPath()
+	owner, err := createLockFile(path, own)
+	if err != nil || owner != nil {
+		return nil, owner, err
+	}
+	owner, err = liveSharedOwner()
+	if err != nil || owner != nil {
+		os.Remove(path)
+		return nil, owner, err
+	}
+	return &RootLock{path: path}, nil, nil
+}
+
+func tryLockShared(own LockOwner) (*RootLock, *LockOwner, error) {
+	path := sharedLockPath(own.PID)
+	err := writeLockFile(path, own)
+	if err != nil {
+		return nil, nil, err
+	}
+	owner, err := liveOwner(exclusiveLockPath())
+	if err != nil || owner != nil {
+		os.Remove(path)
+		return nil, owner, err
+	}
+	return &RootLock{path: path}, nil, nil
+}
+
+// createLockFile atomically creates path with the owner in it. It returns the owner of the
+// existing lock if there is a live one.
+func createLockFile(path string, own LockOwner) (*LockOwner, error) {
+	// the owner is written before the lock file appears, so nobody ever reads an empty lock file.
+	// The temporary file is unique, goroutines of one process may race for a cache lock.
+	data, err := json.Marshal(own)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	_, err = f.Write(data)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = os.Link(tmp, path)
+		if err == nil || !os.IsExist(err) {
+			return nil, err
+		}
+		owner, err := liveOwner(path)
+		if err != nil || owner != nil {
+			return owner, err
+		}
+	}
+}
+
+func writeLockFile(path string, own LockOwner) error {
+	data, err := json.Marshal(own)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readLockFile(path string) (LockOwner, error) {
+	var owner LockOwner
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return owner, err
+	}
+	err = json.Unmarshal(data, &owner)
+	return owner, err
+}
+
+// liveOwner returns the owner of the lock file if its process still runs, and removes the file if not
+func liveOwner(path string) (*LockOwner, error) {
+	owner, err := readLockFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if processAlive(owner.PID) {
+		return &owner, nil
+	}
+	log.Printf("removing stale lock of %s", owner)
+	return nil, removeStaleLock(path, owner)
+}
+
+// removeStaleLock removes the lock file only if it still belongs to stale. Another process may have
+// replaced it with its own since it was read.
+func removeStaleLock(path string, stale LockOwner) error {
+	tmp := fmt.Sprintf("%s.stale-%d", path, os.Getpid())
+	err := os.Rename(path, tmp)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if owner, err := readLockFile(tmp); err == nil && (owner.PID != stale.PID || !owner.Since.Equal(stale.Since)) {
+		// not the stale lock, put it back unless someone else took the lock meanwhile
+		os.Link(tmp, path)
+	}
+	return nil
+}
+
+// liveSharedOwner returns the owner of a shared lock whose process still runs
+func liveSharedOwner() (*LockOwner, error) {
+	files, err := os.ReadDir(locksDir())
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		// skip the temporary files of writeLockFile and removeStaleLock
+		if !strings.HasPrefix(f.Name(), "shared-") || strings.Contains(f.Name(), ".") {
+			continue
+		}
+		owner, err := liveOwner(filepath.Join(locksDir(), f.Name()))
+		if err != nil || owner != nil {
+			return owner, err
+		}
+	}
+	return nil, nil
+}
+
+// Release removes the lock file, it is a no-op on a nil lock
+func (l *RootLock) Release() error {
+	if l == nil {
+		return nil
+	}
+	return removeIfExists(l.path)
+}
+
+// openRoot takes the lock and finishes an interrupted operation. Only the exclusive lock allows
+// to recover, so a reader that finds a journal takes it for the recovery and then locks again.
+func openRoot(mode LockMode, wait bool, command string) (*RootLock, error) {
+	for {
+		lock, err := lockRoot(mode, wait, command)
+		if err != nil || mode == LockNone {
+			return lock, err
+		}
+		if _, err = os.Stat(journalPath()); os.IsNotExist(err) {
+			return lock, nil
+		}
+		if mode == LockExclusive {
+			err = recoverJournal()
+			if err != nil {
+				lock.Release()
+				return nil, err
+			}
+			return lock, nil
+		}
+		lock.Release()
+		lock, err = lockRoot(LockExclusive, wait, command)
+		if err != nil {
+			return nil, err
+		}
+		err = recoverJournal()
+		lock.Release()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
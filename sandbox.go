@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PluginPermissions are declared in the manifest and must be approved by the user before any script runs
+type PluginPermissions struct {
+	// Filesystem holds paths relative to the BDS root that scripts may access besides the plugin directory
+	Filesystem []string
+	// Commands holds the executables system.Cmd may run
+	Commands []string
+	// Network allows scripts to use network.Get
+	Network bool
+}
+
+func (p PluginPermissions) empty() bool {
+	return len(p.Filesystem) == 0 && len(p.Commands) == 0 && !p.Network
+}
+
+// covers reports whether every permission in other is also granted by p
+func (p PluginPermissions) covers(other PluginPermissions) bool {
+	if other.Network && !p.Network {
+		return false
+	}
+	for _, path := range other.Filesystem {
+		if !containsString(p.Filesystem, path) {
+			return false
+		}
+	}
+	for _, cmd := range other.Commands {
+		if !containsString(p.Commands, cmd) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionError is raised in a script that calls outside of its approved permissions
+type PermissionError struct {
+	Op     string
+	Target string
+	Reason string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Op, e.Target, e.Reason)
+}
+
+// vmSandbox limits what the scripting VM can reach
+type vmSandbox struct {
+	PluginPath string   // absolute path of the plugin directory
+	ServerRoot string   // absolute path of the BDS root
+	Filesystem []string // absolute paths under ServerRoot granted besides PluginPath
+	Commands   []string
+	Network    bool
+}
+
+// assumeYes is set by the global --yes flag, permissions are approved without asking
+var assumeYes bool
+
+func confirm(question string) bool {
+	if assumeYes {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// approvePermissions returns the permissions requested by the plugin once the user approved them.
+// Approvals are stored in PluginManager.json, so a plugin is only asked again if it requests more.
+func approvePermissions(p PluginInfo) (PluginPermissions, error) {
+	requested := p.Manifest.Permissions
+	if requested.empty() || GlobalConfig.Approved[p.Name].covers(requested) {
+		return requested, nil
+	}
+
+	log.Printf("%s[%s] requests the following permissions", p.Name, p.Version)
+	for _, path := range requested.Filesystem {
+		log.Printf("\tfilesystem\t%s", path)
+	}
+	for _, cmd := range requested.Commands {
+		log.Printf("\tcommand\t%s", cmd)
+	}
+	if requested.Network {
+		log.Printf("\tnetwork")
+	}
+	if !confirm("Allow?") {
+		return PluginPermissions{}, &PermissionError{Op: "install", Target: p.Name, Reason: "permissions were not approved"}
+	}
+
+	if GlobalConfig.Approved == nil {
+		GlobalConfig.Approved = map[string]PluginPermissions{}
+	}
+	GlobalConfig.Approved[p.Name] = requested
+	return requested, saveConfig()
+}
+
+func newPluginSandbox(p PluginInfo, permissions PluginPermissions) (*vmSandbox, error) {
+	serverRoot, err := filepath.Abs(serverDir())
+	if err != nil {
+		return nil, err
+	}
+	pluginPath, err := filepath.Abs(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	s := &vmSandbox{
+		PluginPath: pluginPath,
+		ServerRoot: serverRoot,
+		Commands:   permissions.Commands,
+		Network:    permissions.Network,
+	}
+	for _, path := range permissions.Filesystem {
+		abs := filepath.Join(serverRoot, path)
+		if !isWithin(abs, serverRoot) {
+			return nil, &PermissionError{Op: "filesystem", Target: path, Reason: "path is outside of the BDS root"}
+		}
+		s.Filesystem = append(s.Filesystem, abs)
+	}
+	return s, nil
+}
+
+// isWithin reports whether path is root or inside of it, both must be absolute and clean
+func isWithin(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolvePath follows the symlinks of the deepest existing ancestor of path,
+// so a link inside an allowed directory can't be used to escape it
+func resolvePath(path string) string {
+	rest := ""
+	for {
+		if real, err := filepath.EvalSymlinks(path); err == nil {
+			return filepath.Join(real, rest)
+		}
+		parent, name := filepath.Split(path)
+		parent = filepath.Clean(parent)
+		if parent == path {
+			return filepath.Join(path, rest)
+		}
+		path = parent
+		rest = filepath.Join(name, rest)
+	}
+}
+
+// checkPath returns the absolute path if the sandbox may access it, relative paths are relative to the BDS root
+func (s *vmSandbox) checkPath(op, path string) (string, error) {
+	abs := path
+	if !filepath.IsAbs(path) {
+		abs = filepath.Join(s.ServerRoot, path)
+	}
+	real := resolvePath(abs)
+	roots := append([]string{s.PluginPath}, s.Filesystem...)
+	if isWithin(real, resolvePath(s.ServerRoot)) {
+		for _, root := range roots {
+			if isWithin(real, resolvePath(root)) {
+				return abs, nil
+			}
+		}
+	}
+	return "", &PermissionError{Op: op, Target: path, Reason: "path is outside of the plugin directory and the approved paths"}
+}
+
+func (s *vmSandbox) checkCommand(name string) error {
+	if containsString(s.Commands, name) {
+		return nil
+	}
+	return &PermissionError{Op: "cmd", Target: name, Reason: "command is not approved"}
+}
+
+func (s *vmSandbox) checkNetwork(url string) error {
+	if s.Network {
+		return nil
+	}
+	return &PermissionError{Op: "network", Target: url, Reason: "network access is not approved"}
+}
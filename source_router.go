@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// SourceRoute sends every module path matching Pattern to Source instead of Config.Source
+type SourceRoute struct {
+	// Pattern holds comma-separated glob patterns of module path prefixes, like GOPRIVATE
+	Pattern string `json:"pattern"`
+	// Source is a source list with the same syntax as Config.Source
+	Source string `json:"source"`
+}
+
+// proxySource is one entry of a GOPROXY-style source list
+type proxySource struct {
+	Url string
+	// FallbackOnAnyError is true if the entry was followed by "|", so the next entry is tried
+	// after any error. After "," the next entry is only tried if the module was not found.
+	FallbackOnAnyError bool
+}
+
+var errSourceOff = errors.New("module lookup disabled by source \"off\"")
+
+// errSourceDirect is returned when the list reaches "direct", modules are only downloaded from proxies
+var errSourceDirect = errors.New("downloading directly from version control is not supported, configure a proxy source")
+
+// sourceEndError is returned when the list reaches "off" or "direct", it keeps the error of the sources before it
+type sourceEndError struct {
+	end  error
+	last error
+}
+
+func (e *sourceEndError) Error() string {
+	if e.last == nil {
+		return e.end.Error()
+	}
+	return fmt.Sprintf("%v, then %v", e.last, e.end)
+}
+
+func (e *sourceEndError) Unwrap() error {
+	return e.last
+}
+
+func (e *sourceEndError) Is(target error) bool {
+	return target == e.end
+}
+
+// parseSourceList parses a GOPROXY-style list, entries are separated by "," or "|"
+// and may be a proxy url, "direct" or "off". Downloading directly from version control is not
+// supported, so "direct" only fails when the list falls back to it, like "off".
+func parseSourceList(list string) ([]proxySource, error) {
+	var sources []proxySource
+	for list != "" {
+		var entry string
+		var anyError bool
+		if i := strings.IndexAny(list, ",|"); i >= 0 {
+			entry = list[:i]
+			anyError = list[i] == '|'
+			list = list[i+1:]
+		} else {
+			entry = list
+			list = ""
+		}
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		sources = append(sources, proxySource{
+			Url:                strings.TrimSuffix(entry, "/"),
+			FallbackOnAnyError: anyError,
+		})
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("source list is empty")
+	}
+	return sources, nil
+}
+
+// validateSources checks the source lists of the config, so a bad list fails when it is loaded
+func validateSources(c Config) error {
+	if c.Source != "" {
+		if _, err := parseSourceList(c.Source); err != nil {
+			return err
+		}
+	}
+	for _, r := range c.Routes {
+		if _, err := parseSourceList(r.Source); err != nil {
+			return fmt.Errorf("route %q: %w", r.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// routedPatterns returns the patterns of all routes, joined like GOPRIVATE
+func routedPatterns() string {
+	var patterns []string
+	for _, r := range GlobalConfig.Routes {
+		patterns = append(patterns, r.Pattern)
+	}
+	return strings.Join(patterns, ",")
+}
+
+// offlineOverride is set by --offline and serve without --upstream for a single run,
+// it is never saved to PluginManager.json
+var offlineOverride bool
+
+// offline reports whether lookups only use the download cache
+func offline() bool {
+	return offlineOverride || GlobalConfig.Offline
+}
+
+// sourcesFor returns the source list used for modulePath: the first matching route, or Config.Source.
+// In offline mode the download cache is the only source.
+func sourcesFor(modulePath string) ([]proxySource, error) {
+	if offline() {
+		cacheUrl, err := pathToFileUrl(cacheDir())
+		if err != nil {
+			return nil, err
+		}
+		return []proxySource{{Url: cacheUrl}}, nil
+	}
+	for _, r := range GlobalConfig.Routes {
+		if module.MatchPrefixPatterns(r.Pattern, modulePath) {
+			return parseSourceList(r.Source)
+		}
+	}
+	source := GlobalConfig.Source
+	if source == "" {
+		source = DefaultDownloadSource
+	}
+	return parseSourceList(source)
+}
+
+// fetchFromSources calls fetch with each source configured for modulePath until one succeeds.
+// Like GOPROXY, after a "," only a not found error falls back to the next source, after a "|" any error does.
+func fetchFromSources(modulePath string, fetch func(goproxyUrl string) error) error {
+	sources, err := sourcesFor(modulePath)
+	if err != nil {
+		return err
+	}
+	err = nil
+	for _, s := range sources {
+		switch s.Url {
+		case "off":
+			return &sourceEndError{end: errSourceOff, last: err}
+		case "direct":
+			return &sourceEndError{end: errSourceDirect, last: err}
+		}
+		err = fetch(s.Url)
+		if err == nil {
+			return nil
+		}
+		if !s.FallbackOnAnyError && !isNotFound(err) {
+			return err
+		}
+	}
+	return err
+}
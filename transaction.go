@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Transaction makes installs, upgrades and removes all or nothing. Packages are extracted into its
+// staging directory and moved into place, files that are replaced or removed are moved into it,
+// and the state files are copied into it, so a rollback can restore the previous state exactly.
+// The staging directory is under PluginManagerRoot, so every move is a rename on the same file system.
+// Every step on the file system is written to the journal first, so recoverJournal can roll back
+// a transaction whose process was killed.
+type Transaction struct {
+	Dir     string
+	journal *os.File
+	undo    []func() error
+	n       int
+}
+
+func stagingDir() string {
+	return filepath.Join(PluginManagerRoot, "staging")
+}
+
+// beginTransaction creates the staging directory and the journal, and snapshots PluginManager.json,
+// the lock file and deployments.json. name describes the operation in the log of a recovery.
+func beginTransaction(name string) (*Transaction, error) {
+	err := os.MkdirAll(stagingDir(), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(stagingDir(), "tx-")
+	if err != nil {
+		return nil, err
+	}
+	journal, err := os.OpenFile(journalPath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	t := &Transaction{Dir: dir, journal: journal}
+	// the state in memory has to match the restored files, undone last it runs after they are restored
+	t.onRollback(loadConfig)
+	err = appendJournal(journal, JournalEntry{Op: JournalBegin, Name: name, Path: dir})
+	for _, f := range []string{configFilePath(), lockFilePath(), deploymentsPath()} {
+		if err == nil {
+			err = t.snapshot(f)
+		}
+	}
+	if err != nil {
+		t.Rollback()
+		return nil, err
+	}
+	return t, nil
+}
+
+// inTransaction runs f in a new transaction, which is committed if f succeeds and rolled back otherwise
+func inTransaction(name string, f func(t *Transaction) error) error {
+	t, err := beginTransaction(name)
+	if err != nil {
+		return err
+	}
+	err = f(t)
+	if err != nil {
+		log.Printf("rolling back: %v", err)
+		if rbErr := t.Rollback(); rbErr != nil {
+			log.Println(rbErr)
+		}
+		return err
+	}
+	return t.Commit()
+}
+
+// onRollback registers f to undo a step, steps are undone in reverse order
+func (t *Transaction) onRollback(f func() error) {
+	t.undo = append(t.undo, f)
+}
+
+// tempPath returns a new path inside the staging directory
+func (t *Transaction) tempPath(name string) string {
+	t.n++
+	return filepath.Join(t.Dir, fmt.Sprintf("%d-%s", t.n, name))
+}
+
+// snapshot copies the file, so a rollback restores its content, or removes it if it doesn't exist yet
+func (t *Transaction) snapshot(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return t.create(path)
+	}
+	backup := t.tempPath(filepath.Base(path))
+	err := copyLocalFile(path, backup)
+	if err != nil {
+		return err
+	}
+	err = appendJournal(t.journal, JournalEntry{Op: JournalSnapshot, Path: path, Backup: backup})
+	if err != nil {
+		return err
+	}
+	t.onRollback(func() error {
+		return copyLocalFile(backup, path)
+	})
+	return nil
+}
+
+// remove moves the file or directory into the staging directory, a rollback moves it back
+func (t *Transaction) remove(path string) error {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+	backup := t.tempPath(filepath.Base(path))
+	err := appendJournal(t.journal, JournalEntry{Op: JournalRemove, Path: path, Backup: backup})
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path, backup)
+	if err != nil {
+		return err
+	}
+	t.onRollback(func() error {
+		err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err != nil {
+			return err
+		}
+		return os.Rename(backup, path)
+	})
+	return nil
+}
+
+// create registers a file or directory the transaction is about to create, a rollback removes it.
+// It has to be called before path is created.
+func (t *Transaction) create(path string) error {
+	err := appendJournal(t.journal, JournalEntry{Op: JournalCreate, Path: path})
+	if err != nil {
+		return err
+	}
+	t.onRollback(func() error {
+		return os.RemoveAll(path)
+	})
+	return nil
+}
+
+// mkdirAll creates dir and its missing parents, a rollback removes the ones it created
+func (t *Transaction) mkdirAll(dir string) error {
+	missing := ""
+	for p := dir; ; p = filepath.Dir(p) {
+		if _, err := os.Stat(p); err == nil {
+			break
+		}
+		missing = p
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+	if missing == "" {
+		return nil
+	}
+	err := t.create(missing)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, os.ModePerm)
+}
+
+// move moves a staged file or directory into place, the target must not exist
+func (t *Transaction) move(staged, target string) error {
+	if _, err := os.Lstat(target); err == nil {
+		return fmt.Errorf("%s already exists", target)
+	}
+	err := t.mkdirAll(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	err = t.create(target)
+	if err != nil {
+		return err
+	}
+	return os.Rename(staged, target)
+}
+
+// Commit deletes the staging directory with everything that was removed or replaced, and the journal
+func (t *Transaction) Commit() error {
+	t.undo = nil
+	err := appendJournal(t.journal, JournalEntry{Op: JournalCommit})
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(t.Dir)
+	if err != nil {
+		return err
+	}
+	return t.closeJournal()
+}
+
+// Rollback undoes every step in reverse order. A failing step doesn't stop the others,
+// the first error is returned and the journal is left for recoverJournal.
+func (t *Transaction) Rollback() error {
+	var first error
+	for k := len(t.undo) - 1; k >= 0; k-- {
+		if err := t.undo[k](); err != nil {
+			log.Printf("rollback: %v", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	t.undo = nil
+	if first != nil {
+		// keep the journal and the staging directory, the next start tries again
+		t.journal.Close()
+		return first
+	}
+	err := os.RemoveAll(t.Dir)
+	if err != nil {
+		return err
+	}
+	return t.closeJournal()
+}
+
+func (t *Transaction) closeJournal() error {
+	err := t.journal.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(journalPath())
+}
+
+func removeIfExists(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
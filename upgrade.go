@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// UpgradeLimit is the largest semver component an upgrade may change
+type UpgradeLimit int
+
+const (
+	UpgradePatch UpgradeLimit = iota
+	UpgradeMinor
+	UpgradeMajor
+)
+
+type PluginUpgrade struct {
+	Plugin PluginInfo
+	From   string
+	To     string
+}
+
+// allowedUpgrade reports whether upgrading from current to v stays within limit
+func allowedUpgrade(current, v string, limit UpgradeLimit) bool {
+	switch limit {
+	case UpgradePatch:
+		return semver.MajorMinor(v) == semver.MajorMinor(current)
+	case UpgradeMinor:
+		return semver.Major(v) == semver.Major(current)
+	}
+	return true
+}
+
+// selectUpgrade returns the highest of versions newer than current within limit, or an empty string
+// if there is none. Pre-releases are only considered if current is a pre-release.
+func selectUpgrade(current string, versions []string, limit UpgradeLimit) string {
+	best := ""
+	for _, v := range versions {
+		if !semver.IsValid(v) || semver.Compare(v, current) <= 0 {
+			continue
+		}
+		if semver.Prerelease(v) != "" && semver.Prerelease(current) == "" {
+			continue
+		}
+		if !allowedUpgrade(current, v, limit) {
+			continue
+		}
+		if best == "" || semver.Compare(v, best) > 0 {
+			best = v
+		}
+	}
+	return best
+}
+
+// findUpgrade returns the highest remote version of the plugin newer than the installed one within limit,
+// skipping retracted versions, or an empty string if there is none
+func findUpgrade(p PluginInfo, limit UpgradeLimit) (string, error) {
+	versions, _, err := getModuleVersionsStatus(p.Name)
+	if err != nil {
+		return "", err
+	}
+	return selectUpgrade(p.Version.Original(), versions, limit), nil
+}
+
+// newestLocalPackages returns the highest installed version of every plugin
+func newestLocalPackages() (PluginInfos, error) {
+	local, err := getLocalPackages()
+	if err != nil {
+		return nil, err
+	}
+	newest := map[string]int{}
+	var ret PluginInfos
+	for _, p := range local {
+		if k, ok := newest[p.Name]; ok {
+			if p.Version.GreaterThan(ret[k].Version) {
+				ret[k] = p
+			}
+			continue
+		}
+		newest[p.Name] = len(ret)
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+// planUpgrades finds the upgrades of the named plugins, or of every installed plugin if names is empty
+func planUpgrades(names []string, limit UpgradeLimit) (upgrades []PluginUpgrade, err error) {
+	local, err := newestLocalPackages()
+	if err != nil {
+		return nil, err
+	}
+	selected := map[string]bool{}
+	for _, name := range names {
+		selected[name] = false
+	}
+	for _, p := range local {
+		if _, ok := selected[p.Name]; len(names) > 0 && !ok {
+			continue
+		}
+		selected[p.Name] = true
+		to, err := findUpgrade(p, limit)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Name, err)
+		}
+		if to != "" {
+			upgrades = append(upgrades, PluginUpgrade{Plugin: p, From: p.Version.Original(), To: to})
+		}
+	}
+	for name, found := range selected {
+		if !found {
+			return nil, &PluginNotFoundError{Name: name}
+		}
+	}
+	return
+}
+
+// upgradePlugin installs the new version together with its dependencies, and only
+// removes the old version after the new one has been installed successfully.
+func upgradePlugin(t *Transaction, u PluginUpgrade) error {
+	graph, err := resolveDependencies(module.Version{Path: u.Plugin.Name, Version: u.To})
+	if err != nil {
+		return err
+	}
+	graph.Print()
+
+	lock, err := loadLockFile()
+	if err != nil {
+		return err
+	}
+	direct := ""
+	if locked := lock.Find(u.Plugin.Name, u.From); locked == nil || locked.Direct {
+		direct = u.Plugin.Name
+	}
+	_, err = installBuildList(t, graph.BuildList, direct)
+	if err != nil {
+		return err
+	}
+
+	err = removePlugin(t, u.Plugin)
+	if err != nil {
+		return err
+	}
+	// installBuildList saved the lock file, load it again before removing the old version
+	lock, err = loadLockFile()
+	if err != nil {
+		return err
+	}
+	lock.Remove(u.Plugin.Name, u.From)
+	err = lock.Save()
+	if err != nil {
+		return err
+	}
+	log.Printf("Upgraded %s %s -> %s", u.Plugin.Name, u.From, u.To)
+	return removeEmptyFolders(filepath.Join(PluginManagerRoot, "pkg"))
+}
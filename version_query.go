@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// NoMatchingVersionError is returned when no version of the module matches the query
+type NoMatchingVersionError struct {
+	Path  string
+	Query string
+}
+
+func (e *NoMatchingVersionError) Error() string {
+	return fmt.Sprintf("%s: no matching versions for query %q", e.Path, e.Query)
+}
+
+// queryModuleVersion resolves a version query like the go command does:
+//   - "latest": the highest release, or the highest pre-release if there is no release
+//   - "upgrade": like latest, but never older than the installed version
+//   - "patch": the highest release with the same major and minor version as the installed one
+//   - "v1", "v1.2": the highest release with that prefix
+//   - "<v1.2.3", ">=v1.2 <v2": the highest release within all comparisons, the "v" may be left out
+//   - "v1.2.3": exactly that version
+//   - anything else is a branch name or commit hash, the proxy resolves it to a pseudo-version
+//
+// A leading "@" is ignored. Retracted versions only match exactly, pre-releases only match if prerelease
+// is set or the query names a pre-release.
+func queryModuleVersion(modulePath, query string, prerelease bool) (ModuleVersionInfo, error) {
+	query = strings.TrimPrefix(strings.TrimSpace(query), "@")
+	switch query {
+	case "", "latest":
+		if !prerelease {
+			return getModuleVersionLatest(modulePath)
+		}
+		return selectQueryVersion(modulePath, query, func(v string) bool { return true }, true)
+	case "upgrade", "patch":
+		current, err := installedVersion(modulePath)
+		if err != nil {
+			return ModuleVersionInfo{}, err
+		}
+		if current == "" {
+			return queryModuleVersion(modulePath, "latest", prerelease)
+		}
+		info, err := selectQueryVersion(modulePath, query, func(v string) bool {
+			if semver.Compare(v, current) < 0 {
+				return false
+			}
+			return query == "upgrade" || semver.MajorMinor(v) == semver.MajorMinor(current)
+		}, prerelease || semver.Prerelease(current) != "")
+		if isNotFound(err) {
+			// the installed version may have been removed from the source, or be a pseudo-version
+			return getModuleVersionInfo(modulePath, current)
+		}
+		return info, err
+	}
+
+	match, wantsPrerelease, ok, err := parseVersionRange(query)
+	if err != nil {
+		return ModuleVersionInfo{}, err
+	}
+	if ok {
+		return selectQueryVersion(modulePath, query, match, prerelease || wantsPrerelease)
+	}
+
+	info, err := getModuleVersionInfo(modulePath, query)
+	if err != nil {
+		return info, err
+	}
+	if !semver.IsValid(info.Version) {
+		return info, fmt.Errorf("%s: query %q resolved to invalid version %q", modulePath, query, info.Version)
+	}
+	return info, nil
+}
+
+// parseVersionRange parses a semver prefix like "v1" or "v1.2", or space separated comparisons
+// like ">=v1.2 <v2". ok is false if query is neither, so it is an exact version, branch or commit.
+func parseVersionRange(query string) (match func(v string) bool, wantsPrerelease bool, ok bool, err error) {
+	if semver.IsValid(query) && semver.Canonical(query) != query && strings.Count(query, ".") < 2 &&
+		semver.Prerelease(query) == "" && semver.Build(query) == "" {
+		return func(v string) bool {
+			return v == query || strings.HasPrefix(v, query+".")
+		}, false, true, nil
+	}
+
+	fields := strings.Fields(query)
+	if len(fields) == 0 || !strings.ContainsAny(fields[0][:1], "<>") {
+		return nil, false, false, nil
+	}
+	var checks []func(v string) bool
+	for _, f := range fields {
+		op := ""
+		for _, o := range []string{"<=", ">=", "<", ">"} {
+			if strings.HasPrefix(f, o) {
+				op = o
+				break
+			}
+		}
+		bound := strings.TrimPrefix(f, op)
+		if op == "" || bound == "" {
+			return nil, false, false, &UsageError{Message: fmt.Sprintf("invalid comparison %q in version query %q", f, query)}
+		}
+		if !strings.HasPrefix(bound, "v") {
+			bound = "v" + bound
+		}
+		if !semver.IsValid(bound) {
+			return nil, false, false, &UsageError{Message: fmt.Sprintf("invalid version %q in version query %q", bound, query)}
+		}
+		if semver.Prerelease(bound) != "" {
+			wantsPrerelease = true
+		}
+		checks = append(checks, func(v string) bool {
+			c := semver.Compare(v, bound)
+			switch op {
+			case "<":
+				return c < 0
+			case "<=":
+				return c <= 0
+			case ">":
+				return c > 0
+			}
+			return c >= 0
+		})
+	}
+	return func(v string) bool {
+		for _, check := range checks {
+			if !check(v) {
+				return false
+			}
+		}
+		return true
+	}, wantsPrerelease, true, nil
+}
+
+// selectQueryVersion returns the info of the highest remote version of the module that matches and is not retracted
+func selectQueryVersion(modulePath, query string, match func(v string) bool, prerelease bool) (ModuleVersionInfo, error) {
+	versions, _, err := getModuleVersionsStatus(modulePath)
+	if err != nil {
+		return ModuleVersionInfo{}, err
+	}
+	for k := len(versions) - 1; k >= 0; k-- {
+		v := versions[k]
+		if !semver.IsValid(v) || !prerelease && semver.Prerelease(v) != "" {
+			continue
+		}
+		if match(v) {
+			return getModuleVersionInfo(modulePath, v)
+		}
+	}
+	return ModuleVersionInfo{}, &NoMatchingVersionError{Path: modulePath, Query: query}
+}
+
+// installedVersion returns the highest installed version of the module, or an empty string
+func installedVersion(modulePath string) (string, error) {
+	local, err := newestLocalPackages()
+	if err != nil {
+		return "", err
+	}
+	for _, p := range local {
+		if p.Name == modulePath {
+			return p.Version.Original(), nil
+		}
+	}
+	return "", nil
+}